@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+	"github.com/lelandbatey/histogram_timestamps/timeformat"
+)
+
+// newBinner builds the tbin.Binner described by the command-line flags, of
+// timestamps in units of precision. The accumulated timestamps are needed to
+// resolve an origin of "start" or "end", and may be nil otherwise.
+func newBinner(acc *tbin.Accumulator, loc *time.Location, precision int64) (*tbin.Binner, error) {
+	opts, err := newBinOptions(acc, loc, precision)
+	if err != nil {
+		return nil, err
+	}
+	binner, err := tbin.NewBinner(*unit, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot divide timestamps into bins: %q", err.Error())
+	}
+	return binner, nil
+}
+
+// newBinOptions builds the tbin.BinOptions described by the command-line
+// flags, for timestamps in units of precision. If acc is nil, an origin of
+// "start" or "end" is left unset, since it isn't known until the timestamps
+// have been read.
+func newBinOptions(acc *tbin.Accumulator, loc *time.Location, precision int64) (tbin.BinOptions, error) {
+	opts := tbin.BinOptions{Location: loc, Precision: precision}
+	var err error
+	opts.WeekStart, err = parseWeekStart(*weekStart)
+	if err != nil {
+		return opts, err
+	}
+	if *binOffset != "" {
+		offset, err := parseOffset(*binOffset)
+		if err != nil {
+			return opts, err
+		}
+		opts.Offset = offset / precision
+	}
+	if *binOrigin != "" && (acc != nil || !isRelativeOrigin(*binOrigin)) {
+		origin, err := parseOrigin(*binOrigin, acc, loc, precision)
+		if err != nil {
+			return opts, err
+		}
+		opts.Origin = &origin
+	}
+	return opts, nil
+}
+
+func parseWeekStart(s string) (time.Weekday, error) {
+	switch strings.ToLower(s) {
+	case "mon", "monday":
+		return time.Monday, nil
+	case "sun", "sunday":
+		return time.Sunday, nil
+	}
+	return 0, fmt.Errorf("invalid --week-start %q, must be 'mon' or 'sun'", s)
+}
+
+// parseOffset parses a duration such as "5m" or "-1h30m" into nanoseconds.
+// Both Go durations and bin sizes like "1D" are accepted.
+func parseOffset(s string) (int64, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d.Nanoseconds(), nil
+	}
+	sign := int64(1)
+	spec := s
+	if strings.HasPrefix(spec, "-") {
+		sign, spec = -1, spec[1:]
+	}
+	mult, delt, err := tbin.ParseSpec(spec)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --bin-offset %q: %w", s, err)
+	}
+	if mult > math.MaxInt64/delt {
+		return 0, fmt.Errorf("invalid --bin-offset %q: offset is too large", s)
+	}
+	return sign * mult * delt, nil
+}
+
+// timestampPrecision returns the precision, in nanoseconds, at which
+// timestamps are kept. That's tbin.DEFAULT_PRECISION unless --unit,
+// --bin-offset, or epochUnit, the unit of epoch timestamps, is finer, in
+// which case it's a nanosecond. Timestamps in nanoseconds can only be from
+// 1677 to 2262, so they're only used when needed.
+func timestampPrecision(epochUnit time.Duration) int64 {
+	fine := int64(epochUnit) < tbin.DEFAULT_PRECISION
+	switch strings.ToLower(*unit) {
+	case "auto", "fd":
+	default:
+		// An invalid --unit is reported once the Binner is built.
+		mult, delt, err := tbin.ParseSpec(*unit)
+		if err == nil && delt < tbin.DEFAULT_PRECISION && mult%(tbin.DEFAULT_PRECISION/delt) != 0 {
+			fine = true
+		}
+	}
+	if *binOffset != "" {
+		if offset, err := parseOffset(*binOffset); err == nil && offset%tbin.DEFAULT_PRECISION != 0 {
+			fine = true
+		}
+	}
+	if fine {
+		return tbin.TD_1_ns
+	}
+	return tbin.DEFAULT_PRECISION
+}
+
+// isRelativeOrigin reports whether the --bin-origin flag s depends on the
+// timestamps being binned.
+func isRelativeOrigin(s string) bool {
+	return strings.EqualFold(s, "start") || strings.EqualFold(s, "end")
+}
+
+// parseOrigin parses the --bin-origin flag, which is either "start" or "end"
+// of the data or an absolute timestamp, into units of precision. Absolute
+// timestamps may be in epoch milliseconds or any format recognized by
+// --auto-format, and are in loc if they don't specify a zone.
+func parseOrigin(s string, acc *tbin.Accumulator, loc *time.Location, precision int64) (int64, error) {
+	switch strings.ToLower(s) {
+	case "start":
+		return acc.Min(), nil
+	case "end":
+		// Put the boundary just after the last timestamp, so that the last
+		// bin ends with the data rather than holding only the last timestamp.
+		if acc.Max() == math.MaxInt64 {
+			return acc.Max(), nil
+		}
+		return acc.Max() + 1, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return tbin.FromTime(time.UnixMilli(ms), precision)
+	}
+	d, err := timeformat.DetectFormat([]string{s})
+	if err != nil {
+		return 0, fmt.Errorf("invalid --bin-origin %q, must be 'start', 'end', or a timestamp: %w", s, err)
+	}
+	parse, _, err := timeformat.NewDetectedFuncs(d, loc)
+	if err != nil {
+		return 0, err
+	}
+	t, err := parse(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --bin-origin %q: %w", s, err)
+	}
+	return tbin.FromTime(t, precision)
+}
+
+// checkBinCount returns an error if filling in every bin between the first
+// and last timestamp would make more than --max-bins bins.
+func checkBinCount(binner *tbin.Binner, acc *tbin.Accumulator) error {
+	if *maxBins <= 0 {
+		return nil
+	}
+	n := binner.CountBins(acc.Min(), acc.Max())
+	if n <= *maxBins {
+		return nil
+	}
+	try := "try --sparse to leave out empty bins, or --clip-percentile to drop outlying timestamps"
+	if larger := largerUnit(binner, acc); larger != "" {
+		try = fmt.Sprintf("try a larger --unit such as %s, --sparse to leave out empty bins, or --clip-percentile to drop outlying timestamps", larger)
+	}
+	return fmt.Errorf("bins of size %s from %s to %s would need about %d bins, more than --max-bins %d; %s",
+		*unit, fmtTimestamp(acc.Min(), acc.Precision()), fmtTimestamp(acc.Max(), acc.Precision()), n, *maxBins, try)
+}
+
+// largerUnit returns the narrowest of tbin.NICE_BIN_SIZES which is wider than
+// the bins of binner, of size --unit, and would make no more than --max-bins
+// bins of the timestamps in acc, or "" if there's none.
+func largerUnit(binner *tbin.Binner, acc *tbin.Accumulator) string {
+	var width int64
+	if mult, delt, err := tbin.ParseSpec(*unit); err == nil {
+		width = mult * delt
+	}
+	for _, spec := range tbin.NICE_BIN_SIZES {
+		mult, delt, err := tbin.ParseSpec(spec)
+		if err != nil || mult*delt <= width {
+			continue
+		}
+		b, err := tbin.NewBinner(spec, tbin.BinOptions{Location: binner.Location(), Precision: binner.Precision()})
+		if err != nil {
+			continue
+		}
+		if b.CountBins(acc.Min(), acc.Max()) <= *maxBins {
+			return spec
+		}
+	}
+	return ""
+}
+
+// newAggregates parses the --agg flags. Without any, bins are shown by their
+// sum of --value-field if it's given, or else by their count of timestamps.
+func newAggregates() ([]tbin.Aggregate, error) {
+	names := *aggFlags
+	if len(names) == 0 {
+		names = []string{"count"}
+		if *valueField != "" {
+			names = []string{"sum"}
+		}
+	}
+	aggs := []tbin.Aggregate{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		agg, err := tbin.ParseAggregate(name)
+		if err != nil {
+			return nil, err
+		}
+		if agg.NeedsValues() && *valueField == "" {
+			return nil, fmt.Errorf("the %s of each bin needs --value-field to say which values to aggregate", agg.Name)
+		}
+		if seen[agg.Name] {
+			return nil, fmt.Errorf("%s was given more than once", agg.Name)
+		}
+		seen[agg.Name] = true
+		aggs = append(aggs, agg)
+	}
+	return aggs, nil
+}
+
+// needsQuantiles reports whether any of aggs is a percentile.
+func needsQuantiles(aggs []tbin.Aggregate) bool {
+	for _, agg := range aggs {
+		if agg.Kind == tbin.AggQuantile {
+			return true
+		}
+	}
+	return false
+}
+
+// OTHER_SERIES names the series of the timestamps whose --group-by keys
+// aren't among the --max-series largest.
+const OTHER_SERIES = "other"
+
+// chartSeries is the bins of one series of the chart: either every
+// timestamp, or those of one --group-by key.
+type chartSeries struct {
+	// Name is the key of the series, or empty when timestamps aren't
+	// grouped.
+	Name   string
+	Bins   map[int64]int64
+	Values map[int64]*tbin.BinValues
+}
+
+// newChartSeries returns the series of the timestamps in acc: one for each of
+// the --max-series largest --group-by groups and one of the rest, or if
+// timestamps aren't grouped, one of them all. If rebin isn't nil, the bins of
+// acc are re-binned with it.
+func newChartSeries(acc *tbin.Accumulator, rebin *tbin.Binner) []chartSeries {
+	series := []chartSeries{}
+	add := func(name string, a *tbin.Accumulator) {
+		s := chartSeries{Name: name, Bins: a.Bins(), Values: a.Values()}
+		if rebin != nil {
+			s.Bins, s.Values = a.Rebin(rebin), a.RebinValues(rebin)
+		}
+		series = append(series, s)
+	}
+	groups := acc.TopGroups(*maxSeries)
+	if groups == nil {
+		add("", acc)
+		return series
+	}
+	for _, g := range groups {
+		if g.Other {
+			add(OTHER_SERIES, g.Acc)
+		} else {
+			add(g.Key, g.Acc)
+		}
+	}
+	return series
+}
+
+// seriesNames returns the names of series.
+func seriesNames(series []chartSeries) []string {
+	names := []string{}
+	for _, s := range series {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// formatChart converts bins, whose starts are in units of precision, into the
+// data needed to draw them with ChartJS, leaving out the bins in gaps as
+// FormatSparseBinDataForChartJS does. Each of aggs of each of series becomes
+// a dataset, with a Y for every one of bins.
+func formatChart(bins map[int64]int64, series []chartSeries, aggs []tbin.Aggregate, spec string, precision int64, gaps []tbin.Gap) (tbin.ChartJSCtx, error) {
+	ctx, err := tbin.FormatAggregatesForChartJS(bins, nil, nil, spec, precision, gaps)
+	if err != nil {
+		return ctx, err
+	}
+	for _, s := range series {
+		sbins := map[int64]int64{}
+		for k := range bins {
+			sbins[k] = s.Bins[k]
+		}
+		sctx, err := tbin.FormatAggregatesForChartJS(sbins, s.Values, aggs, spec, precision, gaps)
+		if err != nil {
+			return sctx, err
+		}
+		for j, ds := range sctx.Datasets {
+			if aggs[j].NeedsValues() {
+				ds.Label = fmt.Sprintf("%s of %s", ds.Aggregate, *valueField)
+			}
+			ds.Series = s.Name
+			sctx.Datasets[j] = ds
+		}
+		ctx.Datasets = append(ctx.Datasets, sctx.Datasets...)
+	}
+	return ctx, nil
+}
+
+// formatIntervalChart converts the intervals added to acc into the data
+// needed to draw how many were active in each bin of binner.
+func formatIntervalChart(acc *tbin.Accumulator, binner *tbin.Binner) (tbin.ChartJSCtx, error) {
+	ib, err := acc.BinIntervals(binner)
+	if err != nil {
+		return tbin.ChartJSCtx{}, err
+	}
+	if *sparse {
+		return tbin.FormatIntervalsForChartJS(ib, *unit, binner.Precision(), binner.Gaps(ib.Active))
+	}
+	binner.FillGaps(ib.Active)
+	binner.FillGaps(ib.Peak)
+	return tbin.FormatIntervalsForChartJS(ib, *unit, binner.Precision(), nil)
+}
+
+// fmtTimestamp formats ts, which is in units of precision.
+func fmtTimestamp(ts, precision int64) string {
+	return tbin.ToTime(ts, precision).Format(time.RFC3339Nano)
+}
@@ -0,0 +1,108 @@
+package extract
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrHeaderLine is returned by an Extractor for a line which is a header
+// rather than data. Such lines should be skipped silently.
+var ErrHeaderLine = errors.New("line is a header")
+
+// ParseDelimiter turns the value of a command-line delimiter option into the
+// single rune that separates fields. Since tabs are awkward to type on the
+// command line, the escape sequence `\t` and the word "tab" are both accepted
+// as names for the tab character.
+func ParseDelimiter(s string) (rune, error) {
+	switch strings.ToLower(s) {
+	case `\t`, "tab":
+		return '\t', nil
+	}
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, fmt.Errorf("delimiter %q must be exactly one character", s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	return r, nil
+}
+
+// DelimitedExtractor selects a single column of CSV, TSV, or otherwise
+// delimited lines, following the quoting rules of encoding/csv. The column
+// may be picked by its 1-based index (as with cut(1) and awk) or, if the
+// input has a header line, by name.
+//
+// Each line is parsed on its own, so quoted fields which span multiple lines
+// are not supported.
+type DelimitedExtractor struct {
+	delim  rune
+	index  int
+	name   string
+	header bool
+	// sawHeader is set after the header line has been consumed.
+	sawHeader bool
+}
+
+// NewDelimitedExtractor creates a DelimitedExtractor. If field is an integer
+// it is a 1-based column index, otherwise it is the name of a column and
+// header must be true so that the name can be found in the first line.
+func NewDelimitedExtractor(delim rune, field string, header bool) (*DelimitedExtractor, error) {
+	x := &DelimitedExtractor{delim: delim, header: header}
+	if idx, err := strconv.Atoi(field); err == nil {
+		if idx < 1 {
+			return nil, fmt.Errorf("field index %d is invalid, fields are numbered starting from 1", idx)
+		}
+		x.index = idx - 1
+		return x, nil
+	}
+	if field == "" {
+		return nil, fmt.Errorf("a field index or name must be provided")
+	}
+	if !header {
+		return nil, fmt.Errorf("cannot select field by name %q unless the input has a header line", field)
+	}
+	x.name = field
+	x.index = -1
+	return x, nil
+}
+
+func (x *DelimitedExtractor) Extract(line string) (Value, error) {
+	record, err := x.split(line)
+	if err != nil {
+		return Value{}, err
+	}
+	if x.header && !x.sawHeader {
+		x.sawHeader = true
+		if x.name == "" {
+			return Value{}, ErrHeaderLine
+		}
+		for i, col := range record {
+			if strings.TrimSpace(col) == x.name {
+				x.index = i
+				return Value{}, ErrHeaderLine
+			}
+		}
+		return Value{}, fmt.Errorf("no column named %q in header %q", x.name, record)
+	}
+	if x.index < 0 {
+		// The header had no column with the name.
+		return Value{}, fmt.Errorf("no column named %q in header", x.name)
+	}
+	if x.index >= len(record) {
+		return Value{}, ErrNoMatch
+	}
+	return Value{Text: record[x.index]}, nil
+}
+
+func (x *DelimitedExtractor) split(line string) ([]string, error) {
+	rdr := csv.NewReader(strings.NewReader(line))
+	rdr.Comma = x.delim
+	rdr.FieldsPerRecord = -1
+	record, err := rdr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("cannot split line into fields: %w", err)
+	}
+	return record, nil
+}
@@ -0,0 +1,92 @@
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// ErrNoMatch is returned by an Extractor when a line does not contain
+// anything that the Extractor knows how to pull a timestamp out of. Lines
+// which produce ErrNoMatch should be counted and skipped rather than treated
+// as fatal.
+var ErrNoMatch = errors.New("line does not contain a timestamp")
+
+// Value is the portion of a line of input which holds a timestamp.
+type Value struct {
+	Text string
+	// Numeric is true when the input format itself says that the value is a
+	// number (e.g. a JSON number), in which case Text is an epoch value rather
+	// than text for a timeformat.ParseFunc.
+	Numeric bool
+}
+
+// Extractor pulls the portion of a line of input which holds a timestamp, so
+// that it can be handed to a timeformat.ParseFunc.
+type Extractor interface {
+	Extract(line string) (Value, error)
+}
+
+// TimestampGroupName is the name of the capture group which a RegexExtractor
+// will use if the pattern contains it, e.g. `(?P<ts>\d+)`.
+const TimestampGroupName = "ts"
+
+// RegexExtractor finds a timestamp within a line with a regular expression.
+// The text of the capture group named TimestampGroupName is used if the
+// pattern has such a group, otherwise the text of the first capture group is
+// used. If the pattern has no capture groups then the entire match is used.
+type RegexExtractor struct {
+	re    *regexp.Regexp
+	group int
+}
+
+// NewRegexExtractor compiles pattern and figures out which capture group of
+// the pattern holds the timestamp.
+func NewRegexExtractor(pattern string) (*RegexExtractor, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile regex %q: %w", pattern, err)
+	}
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+	if idx := re.SubexpIndex(TimestampGroupName); idx > 0 {
+		group = idx
+	}
+	return &RegexExtractor{re: re, group: group}, nil
+}
+
+// NewRegexGroupExtractor creates a RegexExtractor which uses the text of the
+// capture group of pattern named group, or numbered group counting from 1,
+// rather than the group holding the timestamp. This picks out another part
+// of a line, such as a value to go along with its timestamp.
+func NewRegexGroupExtractor(pattern, group string) (*RegexExtractor, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot compile regex %q: %w", pattern, err)
+	}
+	idx := re.SubexpIndex(group)
+	if n, err := strconv.Atoi(group); err == nil {
+		idx = n
+	}
+	if idx < 1 || idx > re.NumSubexp() {
+		return nil, fmt.Errorf("regex %q has no capture group %q", pattern, group)
+	}
+	return &RegexExtractor{re: re, group: idx}, nil
+}
+
+func (x *RegexExtractor) Extract(line string) (Value, error) {
+	match := x.re.FindStringSubmatchIndex(line)
+	if match == nil {
+		return Value{}, ErrNoMatch
+	}
+	start, end := match[2*x.group], match[2*x.group+1]
+	// An optional group which did not participate in the match is reported
+	// with negative indices.
+	if start < 0 {
+		return Value{}, ErrNoMatch
+	}
+	return Value{Text: line[start:end]}, nil
+}
@@ -0,0 +1,182 @@
+package extract_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/lelandbatey/histogram_timestamps/extract"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegexExtractor(t *testing.T) {
+	type tcase struct {
+		Pattern  string
+		Line     string
+		Expected string
+		ExpErr   error
+	}
+
+	for idx, tc := range []tcase{
+		{`time=(\S+)`, `level=info time=2023-02-27T15:38:17Z msg="hi"`, "2023-02-27T15:38:17Z", nil},
+		{`\d{13}`, `request finished at 1572347470840 after 3ms`, "1572347470840", nil},
+		{`(\w+)=(?P<ts>\d+)`, `start=1572347470840`, "1572347470840", nil},
+		{`^\[([^\]]+)\]`, `[2023-02-28 12:24:13] GET /index.html`, "2023-02-28 12:24:13", nil},
+		{`time=(\S+)`, `level=info msg="no time here"`, "", extract.ErrNoMatch},
+		{`a(\d+)?b`, `ab`, "", extract.ErrNoMatch},
+	} {
+		t.Run(fmt.Sprintf("RegexExtractor case #%d", idx), func(t *testing.T) {
+			x, err := extract.NewRegexExtractor(tc.Pattern)
+			require.NoError(t, err)
+			got, err := x.Extract(tc.Line)
+			require.Equal(t, tc.ExpErr, err)
+			require.Equal(t, tc.Expected, got.Text)
+		})
+	}
+}
+
+func TestNewRegexExtractorInvalid(t *testing.T) {
+	_, err := extract.NewRegexExtractor(`time=(\S+`)
+	require.Error(t, err)
+}
+
+func TestRegexGroupExtractor(t *testing.T) {
+	line := `GET /index.html 200 bytes=5120 at 1572347470840`
+	pattern := `bytes=(?P<bytes>\d+) at (?P<ts>\d+)`
+	for _, group := range []string{"bytes", "1"} {
+		x, err := extract.NewRegexGroupExtractor(pattern, group)
+		require.NoError(t, err)
+		got, err := x.Extract(line)
+		require.NoError(t, err)
+		require.Equal(t, "5120", got.Text)
+	}
+	for _, group := range []string{"size", "0", "3"} {
+		_, err := extract.NewRegexGroupExtractor(pattern, group)
+		require.Error(t, err, group)
+	}
+}
+
+func TestDelimitedExtractor(t *testing.T) {
+	type tcase struct {
+		Delim    rune
+		Field    string
+		Header   bool
+		Lines    []string
+		Expected []string
+	}
+
+	for idx, tc := range []tcase{
+		{',', "2", false,
+			[]string{`a,1572347470840,b`, `"quoted, with comma",1572347471840,c`},
+			[]string{"1572347470840", "1572347471840"}},
+		{',', "created_at", true,
+			[]string{`id,name,created_at`, `1,"Smith, ""Bob""",2023-02-28 12:24:13`, `2,Alice,2023-02-28 12:25:13`},
+			[]string{"", "2023-02-28 12:24:13", "2023-02-28 12:25:13"}},
+		{'\t', "3", true,
+			[]string{"id\tname\tts", "\tnobody\t1572347470840"},
+			[]string{"", "1572347470840"}},
+		{';', "3", false,
+			[]string{`a;b`},
+			[]string{""}},
+	} {
+		t.Run(fmt.Sprintf("DelimitedExtractor case #%d", idx), func(t *testing.T) {
+			x, err := extract.NewDelimitedExtractor(tc.Delim, tc.Field, tc.Header)
+			require.NoError(t, err)
+			for i, line := range tc.Lines {
+				got, err := x.Extract(line)
+				if tc.Header && i == 0 {
+					require.Equal(t, extract.ErrHeaderLine, err)
+					continue
+				}
+				if tc.Expected[i] == "" {
+					require.Equal(t, extract.ErrNoMatch, err)
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, tc.Expected[i], got.Text)
+			}
+		})
+	}
+}
+
+func TestDelimitedExtractorErrors(t *testing.T) {
+	_, err := extract.NewDelimitedExtractor(',', "created_at", false)
+	require.Error(t, err)
+	_, err = extract.NewDelimitedExtractor(',', "0", false)
+	require.Error(t, err)
+
+	x, err := extract.NewDelimitedExtractor(',', "created_at", true)
+	require.NoError(t, err)
+	_, err = x.Extract("id,name,updated_at")
+	require.Error(t, err)
+}
+
+func TestParseDelimiter(t *testing.T) {
+	for idx, tc := range []struct {
+		In       string
+		Expected rune
+	}{
+		{",", ','},
+		{`\t`, '\t'},
+		{"tab", '\t'},
+		{"|", '|'},
+	} {
+		got, err := extract.ParseDelimiter(tc.In)
+		require.NoError(t, err, "for test #%d", idx)
+		require.Equal(t, tc.Expected, got, "for test #%d", idx)
+	}
+	_, err := extract.ParseDelimiter(",,")
+	require.Error(t, err)
+}
+
+func TestJSONExtractor(t *testing.T) {
+	type tcase struct {
+		Path     string
+		Line     string
+		Expected extract.Value
+		ExpErr   error
+	}
+
+	for idx, tc := range []tcase{
+		{".ts", `{"ts": 1572347470840}`, extract.Value{Text: "1572347470840", Numeric: true}, nil},
+		{".request.ts", `{"request": {"ts": "2023-02-27T15:38:17Z"}}`, extract.Value{Text: "2023-02-27T15:38:17Z"}, nil},
+		{"request.ts", `{"request": {"ts": "2023-02-27T15:38:17Z"}}`, extract.Value{Text: "2023-02-27T15:38:17Z"}, nil},
+		{"events[0].time", `{"events": [{"time": 1572347470840}, {"time": 1}]}`, extract.Value{Text: "1572347470840", Numeric: true}, nil},
+		{".events[1]", `{"events": [1, "2023-02-28"]}`, extract.Value{Text: "2023-02-28"}, nil},
+		{`["@timestamp"]`, `{"@timestamp": "2023-02-28"}`, extract.Value{Text: "2023-02-28"}, nil},
+		{`.meta["k.with.dots"]`, `{"meta": {"k.with.dots": 12}}`, extract.Value{Text: "12", Numeric: true}, nil},
+		{".ts", `{"other": 1}`, extract.Value{}, extract.ErrNoMatch},
+		{".ts", `{"ts": null}`, extract.Value{}, extract.ErrNoMatch},
+		{"events[3].time", `{"events": []}`, extract.Value{}, extract.ErrNoMatch},
+		{".a.b", `{"a": null}`, extract.Value{}, extract.ErrNoMatch},
+	} {
+		t.Run(fmt.Sprintf("JSONExtractor case #%d", idx), func(t *testing.T) {
+			x, err := extract.NewJSONExtractor(tc.Path)
+			require.NoError(t, err)
+			got, err := x.Extract(tc.Line)
+			require.Equal(t, tc.ExpErr, err)
+			require.Equal(t, tc.Expected, got)
+		})
+	}
+}
+
+func TestJSONExtractorErrors(t *testing.T) {
+	for idx, path := range []string{"", ".", "a..b", "a[", "a[x]", `["a`, "a[0]b"} {
+		_, err := extract.NewJSONExtractor(path)
+		require.Error(t, err, "for path #%d %q", idx, path)
+	}
+
+	for idx, line := range []string{
+		`{"ts": 1`,
+		`not json at all`,
+		`{"ts": 1} {"ts": 2}`,
+		`{"ts": true}`,
+		`{"ts": {"nested": 1}}`,
+	} {
+		x, err := extract.NewJSONExtractor(".ts")
+		require.NoError(t, err)
+		_, err = x.Extract(line)
+		require.Error(t, err, "for line #%d %q", idx, line)
+		require.NotEqual(t, extract.ErrNoMatch, err, "for line #%d %q", idx, line)
+	}
+}
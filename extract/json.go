@@ -0,0 +1,169 @@
+package extract
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathStep is one element of a JSON path: either the key of an object or the
+// index of an array.
+type pathStep struct {
+	Key   string
+	Index int
+	// IsIndex is true if this step indexes into an array rather than an
+	// object.
+	IsIndex bool
+}
+
+func (s pathStep) String() string {
+	if s.IsIndex {
+		return fmt.Sprintf("[%d]", s.Index)
+	}
+	return "." + s.Key
+}
+
+// parseJSONPath parses a jq-like path into the steps needed to walk from the
+// root of a JSON document to a single value. Supported syntax is a series of
+// `.key` object lookups and `[N]` array indexes, along with `["key"]` for
+// keys which contain dots or brackets. The leading dot is optional, so both
+// `.request.ts` and `events[0].time` are valid paths.
+func parseJSONPath(path string) ([]pathStep, error) {
+	steps := []pathStep{}
+	rest := path
+	if strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "..") {
+		rest = rest[1:]
+	}
+	if rest == "" {
+		return nil, fmt.Errorf("JSON path %q does not select any field", path)
+	}
+	first := true
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, `["`):
+			end := strings.Index(rest, `"]`)
+			if end < 0 {
+				return nil, fmt.Errorf("JSON path %q has an unterminated [\"key\"]", path)
+			}
+			steps = append(steps, pathStep{Key: rest[2:end]})
+			rest = rest[end+2:]
+		case strings.HasPrefix(rest, "["):
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("JSON path %q has an unterminated [index]", path)
+			}
+			idx, err := strconv.Atoi(rest[1:end])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("JSON path %q has an invalid array index %q", path, rest[1:end])
+			}
+			steps = append(steps, pathStep{Index: idx, IsIndex: true})
+			rest = rest[end+1:]
+		default:
+			if !first {
+				if !strings.HasPrefix(rest, ".") {
+					return nil, fmt.Errorf("JSON path %q is missing a '.' before %q", path, rest)
+				}
+				rest = rest[1:]
+			}
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("JSON path %q contains an empty key", path)
+			}
+			steps = append(steps, pathStep{Key: rest[:end]})
+			rest = rest[end:]
+		}
+		first = false
+	}
+	return steps, nil
+}
+
+// JSONExtractor decodes each line as a JSON document and selects a single
+// value from it by path. JSON numbers are returned as Numeric values, while
+// JSON strings are returned as text to be parsed. Lines where the path does
+// not exist, or where the value is null, produce ErrNoMatch.
+type JSONExtractor struct {
+	path  string
+	steps []pathStep
+}
+
+// NewJSONExtractor creates a JSONExtractor which selects the value at path.
+func NewJSONExtractor(path string) (*JSONExtractor, error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONExtractor{path: path, steps: steps}, nil
+}
+
+func (x *JSONExtractor) Extract(line string) (Value, error) {
+	dec := json.NewDecoder(strings.NewReader(line))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return Value{}, fmt.Errorf("cannot decode line as JSON: %w", err)
+	}
+	if dec.More() {
+		return Value{}, fmt.Errorf("cannot decode line as JSON: unexpected data after the end of the JSON document")
+	}
+
+	cur := doc
+	for _, step := range x.steps {
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			if step.IsIndex {
+				return Value{}, fmt.Errorf("cannot index %s into a JSON object while following path %q", step, x.path)
+			}
+			v, ok := node[step.Key]
+			if !ok {
+				return Value{}, ErrNoMatch
+			}
+			cur = v
+		case []interface{}:
+			if !step.IsIndex {
+				return Value{}, fmt.Errorf("cannot look up key %s in a JSON array while following path %q", step, x.path)
+			}
+			if step.Index >= len(node) {
+				return Value{}, ErrNoMatch
+			}
+			cur = node[step.Index]
+		case nil:
+			return Value{}, ErrNoMatch
+		default:
+			return Value{}, fmt.Errorf("cannot follow path %q through the JSON value %s", x.path, compactJSON(node))
+		}
+	}
+
+	switch v := cur.(type) {
+	case json.Number:
+		return Value{Text: v.String(), Numeric: true}, nil
+	case string:
+		return Value{Text: v}, nil
+	case nil:
+		return Value{}, ErrNoMatch
+	default:
+		return Value{}, fmt.Errorf("value at path %q is %s, which is neither a string nor a number", x.path, compactJSON(v))
+	}
+}
+
+// compactJSON renders v for use in error messages.
+func compactJSON(v interface{}) string {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return strings.TrimSpace(smax(buf.String(), 80))
+}
+
+func smax(s string, l int) string {
+	if len(s) <= l {
+		return s
+	}
+	return s[:l] + "..."
+}
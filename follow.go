@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+)
+
+const (
+	// tailPollInterval is how often a followed file is checked for more
+	// lines once the end of it has been reached.
+	tailPollInterval = 250 * time.Millisecond
+	// liveUpdateInterval is how often changed bins are pushed to the pages
+	// showing the chart in --follow mode.
+	liveUpdateInterval = 500 * time.Millisecond
+)
+
+// tailReader reads a file, and once the end of the file is reached it waits
+// for more to be written rather than returning io.EOF. If the file is
+// replaced, as when logs are rotated, reading carries on from the start of
+// the new file; if it's truncated, from the start of the file again.
+type tailReader struct {
+	name string
+	file *os.File
+	// next is the file which replaced file, which is switched to once the
+	// rest of file has been read.
+	next *os.File
+	// stopAtEnd makes Read return io.EOF at the end of the file rather than
+	// waiting for more to be written.
+	stopAtEnd bool
+}
+
+func newTailReader(name string) (*tailReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tailReader{name: name, file: file}, nil
+}
+
+func (t *tailReader) Read(p []byte) (int, error) {
+	for {
+		n, err := t.file.Read(p)
+		if err == io.EOF {
+			if n == 0 && t.stopAtEnd {
+				return 0, io.EOF
+			}
+			err = nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+		moved, err := t.rotate()
+		if err != nil {
+			return 0, err
+		}
+		if !moved {
+			time.Sleep(tailPollInterval)
+		}
+	}
+}
+
+// rotate is called at the end of the file being read, and reports whether
+// reading should carry on without waiting because the file was rotated or
+// truncated.
+func (t *tailReader) rotate() (bool, error) {
+	if t.next != nil {
+		t.file.Close()
+		t.file, t.next = t.next, nil
+		return true, nil
+	}
+	cur, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	fi, err := os.Stat(t.name)
+	if err == nil && !os.SameFile(cur, fi) {
+		next, err := os.Open(t.name)
+		if err != nil {
+			// The new file may not be readable just yet.
+			return false, nil
+		}
+		// Lines may have been written to the old file since it was last
+		// read, so read it once more before switching.
+		t.next = next
+		return true, nil
+	}
+	pos, err := t.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return false, err
+	}
+	if cur.Size() < pos {
+		_, err := t.file.Seek(0, io.SeekStart)
+		return err == nil, err
+	}
+	return false, nil
+}
+
+func (t *tailReader) Close() error {
+	if t.next != nil {
+		t.next.Close()
+	}
+	return t.file.Close()
+}
+
+// liveEvent is a message pushed to the pages showing the chart, as a
+// server-sent event.
+type liveEvent struct {
+	Name string
+	Data []byte
+}
+
+// liveChart holds the bins of the timestamps read in --follow mode, and
+// pushes the bins which change to every page showing the chart.
+//
+// Pages are sent a "reset" event with every bin when they connect, and then
+// an "update" event with the bins which changed every liveUpdateInterval.
+// With --sparse an update may need to move the gaps between bins, so every
+// bin is sent in a reset instead.
+type liveChart struct {
+	mu      sync.Mutex
+	acc     *tbin.Accumulator
+	binner  *tbin.Binner
+	aggs    []tbin.Aggregate
+	spec    string
+	binTZ   string
+	sparse  bool
+	maxBins int64
+	report  parseReport
+	// dirty is set when lines have been read since the last update.
+	dirty bool
+	// series are the names of the series pages were last sent. When lines
+	// are grouped, the largest groups may change, so pages are sent every
+	// bin of the new series.
+	series []string
+	// shown is set once updates have been sent with bins, which then span
+	// from lo to hi. Pages which connected since have been sent every bin,
+	// so every page has at least these.
+	shown   bool
+	lo, hi  int64
+	clients map[chan liveEvent]bool
+}
+
+// newLiveChart creates a liveChart of the timestamps added to acc, which
+// must bin them with binner, showing each of aggs. Unless sparse is set, timestamps which would
+// make the chart span more than maxBins bins are rejected.
+func newLiveChart(acc *tbin.Accumulator, binner *tbin.Binner, aggs []tbin.Aggregate, spec, binTZ string, sparse bool, maxBins int64) *liveChart {
+	acc.TrackChanges()
+	return &liveChart{
+		acc:     acc,
+		binner:  binner,
+		aggs:    aggs,
+		spec:    spec,
+		binTZ:   binTZ,
+		sparse:  sparse,
+		maxBins: maxBins,
+		clients: map[chan liveEvent]bool{},
+	}
+}
+
+// Context returns the chart of every bin so far, along with the parse report
+// of the lines read so far.
+func (l *liveChart) Context() (tbin.ChartJSCtx, parseReport, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx, err := l.context()
+	return ctx, l.report, err
+}
+
+// context returns the chart of every bin so far; l.mu must be held.
+func (l *liveChart) context() (tbin.ChartJSCtx, error) {
+	bins := map[int64]int64{}
+	for k, v := range l.acc.Bins() {
+		bins[k] = v
+	}
+	series := newChartSeries(l.acc, nil)
+	l.series = seriesNames(series)
+	var ctx tbin.ChartJSCtx
+	var err error
+	if l.sparse {
+		ctx, err = formatChart(bins, series, l.aggs, l.spec, l.binner.Precision(), l.binner.Gaps(bins))
+	} else {
+		l.binner.FillGaps(bins)
+		ctx, err = formatChart(bins, series, l.aggs, l.spec, l.binner.Precision(), nil)
+	}
+	if err != nil {
+		return ctx, err
+	}
+	ctx.BinTZ = l.binTZ
+	return ctx, nil
+}
+
+// add adds the timestamp of pl to the chart, unless it's so far from the
+// other timestamps that there'd be too many bins; l.mu must be held.
+func (l *liveChart) add(pl parsedLine) error {
+	ts := pl.TS
+	if !l.sparse && l.maxBins > 0 && l.acc.Count() > 0 {
+		first, last := l.acc.Min(), l.acc.Max()
+		if ts < first {
+			first = ts
+		}
+		if ts > last {
+			last = ts
+		}
+		if n := l.binner.CountBins(first, last); n > l.maxBins {
+			return fmt.Errorf("%s is so far from the other timestamps that the chart would need about %d bins, more than --max-bins %d", fmtTimestamp(ts, l.binner.Precision()), n, l.maxBins)
+		}
+	}
+	l.acc.AddGrouped(pl.Key, ts, pl.Value)
+	return nil
+}
+
+// Follow reads lines from f until it ends, which a followed file never
+// does, adding the timestamp of each to the chart. Failing lines are handled
+// according to policy, as with read_lines_to_integers.
+func (l *liveChart) Follow(f *inputFile, newParser func() (*lineParser, error), policy errorPolicy) error {
+	if err := f.Open(); err != nil {
+		return err
+	}
+	defer f.Close()
+	p, err := newParser()
+	if err != nil {
+		return err
+	}
+	fail := newFailureHandler(policy, &l.report)
+	br := bufio.NewReader(f.Reader())
+	for i := 1; ; i++ {
+		line, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return fmt.Errorf("cannot read line %d of %s: %w", i, f, rerr)
+		}
+		if line == "" && rerr == io.EOF {
+			return nil
+		}
+		line = trimLineEnding(line)
+		pl, outcome, failure := p.parseLine(f.String(), i, line)
+
+		l.mu.Lock()
+		if outcome == lineParsed {
+			if err := l.add(pl); err != nil {
+				outcome = lineFailed
+				werr := fmt.Errorf("cannot use timestamp on line %d of %s: %w", i, f, err)
+				failure = lineFailure{Input: f.String(), Line: i, Sample: line, Err: werr, Cause: err}
+			}
+		}
+		l.report.count(outcome)
+		var ferr error
+		if outcome == lineFailed {
+			ferr = fail(failure)
+		}
+		l.dirty = true
+		l.mu.Unlock()
+
+		if ferr != nil {
+			return ferr
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+	}
+}
+
+// Run pushes the bins which changed to the pages showing the chart every
+// liveUpdateInterval, forever.
+func (l *liveChart) Run() {
+	for range time.Tick(liveUpdateInterval) {
+		l.mu.Lock()
+		ev, err := l.update()
+		if err == nil && ev != nil {
+			l.broadcast(*ev)
+		}
+		l.mu.Unlock()
+		if err != nil {
+			log.Printf("cannot update the chart: %v\n", err)
+		}
+	}
+}
+
+// update returns the event telling pages about the bins which changed since
+// the last update, or nil if nothing did; l.mu must be held.
+func (l *liveChart) update() (*liveEvent, error) {
+	if !l.dirty {
+		return nil, nil
+	}
+	l.dirty = false
+	changes := l.acc.Changes()
+	series := newChartSeries(l.acc, nil)
+	if l.sparse && len(changes) > 0 || !sameStrings(seriesNames(series), l.series) {
+		return l.reset()
+	}
+	if len(changes) > 0 {
+		l.fillAround(changes)
+	}
+	ctx, err := formatChart(changes, series, l.aggs, l.spec, l.binner.Precision(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return l.event("update", map[string]interface{}{"datasets": ctx.Datasets, "report": l.report})
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fillAround adds the empty bins between the changed bins and those already
+// shown to changes, since bins are shown evenly spaced no matter how far
+// apart they are; l.mu must be held.
+func (l *liveChart) fillAround(changes map[int64]int64) {
+	keys := []int64{}
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	first, last := keys[0], keys[len(keys)-1]
+	if !l.shown {
+		l.binner.FillGaps(changes)
+		l.shown, l.lo, l.hi = true, first, last
+		return
+	}
+	fill := func(from, to int64) {
+		span := map[int64]int64{from: 0, to: 0}
+		l.binner.FillGaps(span)
+		for k := range span {
+			if _, ok := changes[k]; !ok && (k < l.lo || k > l.hi) {
+				changes[k] = 0
+			}
+		}
+	}
+	if first < l.lo {
+		fill(first, l.lo)
+		l.lo = first
+	}
+	if last > l.hi {
+		fill(l.hi, last)
+		l.hi = last
+	}
+}
+
+// reset returns the event giving pages every bin; l.mu must be held.
+func (l *liveChart) reset() (*liveEvent, error) {
+	ctx, err := l.context()
+	if err != nil {
+		return nil, err
+	}
+	return l.event("reset", map[string]interface{}{"context": ctx, "report": l.report})
+}
+
+func (l *liveChart) event(name string, payload interface{}) (*liveEvent, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &liveEvent{Name: name, Data: data}, nil
+}
+
+// broadcast sends ev to every page; l.mu must be held. Pages which have
+// fallen behind are disconnected, and are sent every bin once their browser
+// reconnects.
+func (l *liveChart) broadcast(ev liveEvent) {
+	for c := range l.clients {
+		select {
+		case c <- ev:
+		default:
+			delete(l.clients, c)
+			close(c)
+		}
+	}
+}
+
+// ServeHTTP streams the events of the chart to a page as server-sent
+// events.
+func (l *liveChart) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events := make(chan liveEvent, 16)
+	l.mu.Lock()
+	ev, err := l.reset()
+	if err == nil {
+		l.clients[events] = true
+	}
+	l.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		l.mu.Lock()
+		delete(l.clients, events)
+		l.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	for {
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Name, ev.Data)
+		flusher.Flush()
+		select {
+		case next, ok := <-events:
+			if !ok {
+				return
+			}
+			ev = &next
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTailReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	require.NoError(t, os.WriteFile(path, []byte("1\n2\n"), 0o644))
+	appendTo := func(path, text string) {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(text)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+
+	tr, err := newTailReader(path)
+	require.NoError(t, err)
+	defer tr.Close()
+	tr.stopAtEnd = true
+	got, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	require.Equal(t, "1\n2\n", string(got))
+	tr.stopAtEnd = false
+
+	// Lines are read on another goroutine, since reading waits for more to
+	// be written.
+	lines := make(chan string)
+	go func() {
+		br := bufio.NewReader(tr)
+		for {
+			line, err := br.ReadString('\n')
+			if err != nil {
+				close(lines)
+				return
+			}
+			lines <- trimLineEnding(line)
+		}
+	}()
+	expect := func(exp ...string) {
+		for _, e := range exp {
+			select {
+			case line := <-lines:
+				require.Equal(t, e, line)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for line %q", e)
+			}
+		}
+	}
+
+	appendTo(path, "3\n")
+	expect("3")
+
+	// The file is rotated, with a line written to the old file after it
+	// was renamed, which is read before the new file.
+	require.NoError(t, os.Rename(path, path+".1"))
+	require.NoError(t, os.WriteFile(path, []byte("4\n44\n"), 0o644))
+	appendTo(path+".1", "3b\n")
+	expect("3b", "4", "44")
+
+	// The new file is truncated and written to again.
+	require.NoError(t, os.WriteFile(path, []byte("5\n"), 0o644))
+	expect("5")
+	appendTo(path, "6\n")
+	expect("6")
+}
+
+// liveUpdate is the payload of an "update" event.
+type liveUpdate struct {
+	Datasets []struct {
+		Data []struct {
+			X float64 `json:"x"`
+			Y float64 `json:"y"`
+		} `json:"data"`
+	} `json:"datasets"`
+	Report parseReport `json:"report"`
+}
+
+func TestLiveChartUpdate(t *testing.T) {
+	b, err := tbin.NewBinner("1m", tbin.BinOptions{})
+	require.NoError(t, err)
+	count, err := tbin.ParseAggregate("count")
+	require.NoError(t, err)
+	minute := func(m int64) int64 {
+		return 1700000040000 + m*60000
+	}
+
+	l := newLiveChart(tbin.NewAccumulator(b), b, []tbin.Aggregate{count}, "1m", "UTC", false, 100)
+	// The page is first sent the chart as it is, before anything's read.
+	_, _, err = l.Context()
+	require.NoError(t, err)
+	// add adds a timestamp at each of minutes, as Follow does.
+	add := func(minutes ...int64) {
+		for _, m := range minutes {
+			require.NoError(t, l.add(parsedLine{TS: minute(m), Value: 1}))
+			l.report.count(lineParsed)
+		}
+		l.dirty = true
+	}
+
+	type tcase struct {
+		Minutes []int64
+		// ExpBins are the counts of the bins sent, by minute.
+		ExpBins map[int64]float64
+	}
+	for idx, test := range []tcase{
+		// The first bins are sent with the empty bins between them.
+		{Minutes: []int64{0, 3, 3}, ExpBins: map[int64]float64{0: 1, 1: 0, 2: 0, 3: 2}},
+		// Bins after those shown are sent with the empty bins leading up to
+		// them, and likewise for bins before those shown.
+		{Minutes: []int64{6}, ExpBins: map[int64]float64{4: 0, 5: 0, 6: 1}},
+		{Minutes: []int64{-2}, ExpBins: map[int64]float64{-2: 1, -1: 0}},
+		// Bins which were already shown are sent with their new counts.
+		{Minutes: []int64{1, 5, 5}, ExpBins: map[int64]float64{1: 1, 5: 2}},
+		{Minutes: []int64{8, -3}, ExpBins: map[int64]float64{-3: 1, 7: 0, 8: 1}},
+		{Minutes: []int64{}, ExpBins: map[int64]float64{}},
+	} {
+		add(test.Minutes...)
+		ev, err := l.update()
+		require.NoError(t, err, "for test #%d", idx)
+		require.Equal(t, "update", ev.Name, "for test #%d", idx)
+		var u liveUpdate
+		require.NoError(t, json.Unmarshal(ev.Data, &u), "for test #%d", idx)
+		require.Len(t, u.Datasets, 1, "for test #%d", idx)
+		bins := map[int64]float64{}
+		for _, d := range u.Datasets[0].Data {
+			bins[(int64(d.X)-minute(0))/60000] = d.Y
+		}
+		require.Equal(t, test.ExpBins, bins, "for test #%d", idx)
+		require.Equal(t, int(l.acc.Count()), u.Report.Parsed, "for test #%d", idx)
+
+		// Nothing is sent until more lines are read.
+		ev, err = l.update()
+		require.NoError(t, err)
+		require.Nil(t, ev, "for test #%d", idx)
+	}
+
+	// Timestamps which would make too many bins are rejected.
+	require.Error(t, l.add(parsedLine{TS: minute(200), Value: 1}))
+	require.Equal(t, int64(10), l.acc.Count())
+}
+
+func TestLiveChartUpdateSparse(t *testing.T) {
+	b, err := tbin.NewBinner("1m", tbin.BinOptions{})
+	require.NoError(t, err)
+	count, err := tbin.ParseAggregate("count")
+	require.NoError(t, err)
+	l := newLiveChart(tbin.NewAccumulator(b), b, []tbin.Aggregate{count}, "1m", "UTC", true, 100)
+
+	// Far apart timestamps are fine, since the gaps between them aren't
+	// filled, but every bin is sent again as the gaps may have moved.
+	for _, ts := range []int64{1700000040000, 1800000000000} {
+		require.NoError(t, l.add(parsedLine{TS: ts, Value: 1}))
+		l.dirty = true
+		ev, err := l.update()
+		require.NoError(t, err)
+		require.Equal(t, "reset", ev.Name)
+	}
+}
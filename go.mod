@@ -4,7 +4,9 @@ go 1.16
 
 require (
 	github.com/itchyny/timefmt-go v0.1.3
+	github.com/klauspost/compress v1.15.15
 	github.com/mattn/go-isatty v0.0.14
 	github.com/spf13/pflag v1.0.5
 	github.com/stretchr/testify v1.7.0
+	github.com/ulikunitz/xz v0.5.11
 )
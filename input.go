@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lelandbatey/histogram_timestamps/extract"
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+	"github.com/lelandbatey/histogram_timestamps/timeformat"
+)
+
+// newExtractor builds the extract.Extractor described by the command-line
+// flags. If no flags ask for extraction then a nil Extractor is returned and
+// each entire line is treated as a timestamp.
+func newExtractor() (extract.Extractor, error) {
+	delimited := *field != "" || *delimiter != "" || *header
+	modes := 0
+	for _, enabled := range []bool{*extractRegex != "", delimited, *jsonPath != ""} {
+		if enabled {
+			modes += 1
+		}
+	}
+	if modes > 1 {
+		return nil, fmt.Errorf("only one of --extract-regex, --json-path, or --delimiter/--field/--header may be used at a time")
+	}
+	if *extractRegex != "" {
+		return extract.NewRegexExtractor(*extractRegex)
+	}
+	if *jsonPath != "" {
+		return extract.NewJSONExtractor(*jsonPath)
+	}
+	if delimited {
+		if *field == "" {
+			return nil, fmt.Errorf("--field must be provided to select a column of delimited input")
+		}
+		delim, err := delimiterRune()
+		if err != nil {
+			return nil, err
+		}
+		return extract.NewDelimitedExtractor(delim, *field, *header)
+	}
+	return nil, nil
+}
+
+// newValueExtractor builds the extract.Extractor which finds the
+// --value-field of each line. If --value-field isn't given then a nil
+// Extractor is returned, and each line counts once.
+func newValueExtractor() (extract.Extractor, error) {
+	return newFieldExtractor("--value-field", *valueField)
+}
+
+// newGroupExtractor builds the extract.Extractor which finds the --group-by
+// key of each line, or a nil Extractor if lines aren't grouped.
+func newGroupExtractor() (extract.Extractor, error) {
+	return newFieldExtractor("--group-by", *groupBy)
+}
+
+// newEndExtractor builds the extract.Extractor which finds the --end-field or
+// the --duration-field of each line, and reports which it finds. A nil
+// Extractor is returned unless lines are intervals.
+func newEndExtractor() (extract.Extractor, bool, error) {
+	if *endField != "" {
+		x, err := newFieldExtractor("--end-field", *endField)
+		return x, false, err
+	}
+	x, err := newFieldExtractor("--duration-field", *durField)
+	return x, true, err
+}
+
+// newFieldExtractor builds the extract.Extractor which finds the field named
+// by the flag flagName of each line, in the same way as the timestamp is
+// found by the Extractor from newExtractor: name is a capture group of
+// --extract-regex, a path within JSON lines, or a column of delimited input.
+// If name is empty then a nil Extractor is returned.
+func newFieldExtractor(flagName, name string) (extract.Extractor, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if *extractRegex != "" {
+		return extract.NewRegexGroupExtractor(*extractRegex, name)
+	}
+	if *jsonPath != "" {
+		return extract.NewJSONExtractor(name)
+	}
+	if *field != "" {
+		delim, err := delimiterRune()
+		if err != nil {
+			return nil, err
+		}
+		return extract.NewDelimitedExtractor(delim, name, *header)
+	}
+	return nil, fmt.Errorf("%s must be used along with one of --extract-regex, --json-path, or --field, which say how to find the timestamp", flagName)
+}
+
+// delimiterRune returns the rune separating the fields of delimited input.
+func delimiterRune() (rune, error) {
+	if *delimiter == "" {
+		return ',', nil
+	}
+	return extract.ParseDelimiter(*delimiter)
+}
+
+// utf8BOM is the byte order mark which some tools, notably on Windows, put
+// at the start of UTF-8 text.
+const utf8BOM = "\xef\xbb\xbf"
+
+// skipBOM returns a reader which yields r without its leading UTF-8 byte
+// order mark, if it has one, so that the mark isn't taken as part of the
+// first line.
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(utf8BOM)); err == nil && string(prefix) == utf8BOM {
+		br.Discard(len(utf8BOM))
+	}
+	return br
+}
+
+// sampleInput reads the first n non-empty lines of r and returns the
+// timestamp found within each. The returned reader yields all of r, including
+// the sampled lines.
+func sampleInput(r io.Reader, n int) ([]extract.Value, io.Reader, error) {
+	// The sample gets its own extractor, since some extractors keep state
+	// (such as having seen a header line) which the real pass needs as well.
+	extractor, err := newExtractor()
+	if err != nil {
+		return nil, nil, err
+	}
+	consumed := &bytes.Buffer{}
+	br := bufio.NewReader(r)
+	samples := []extract.Value{}
+	for len(samples) < n {
+		line, err := br.ReadString('\n')
+		consumed.WriteString(line)
+		if line = strings.TrimRight(line, "\r\n"); strings.TrimSpace(line) != "" {
+			val := extract.Value{Text: line}
+			if extractor != nil {
+				var xerr error
+				val, xerr = extractor.Extract(line)
+				if xerr != nil {
+					val = extract.Value{}
+				}
+			}
+			val.Text = strings.TrimSpace(val.Text)
+			if val.Text != "" {
+				samples = append(samples, val)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return samples, io.MultiReader(consumed, br), nil
+}
+
+// detectFormat picks the format which parses the most of the sampled
+// timestamps, reporting the choice on stderr. If the timestamps look like
+// epoch values then a nil ParseFunc is returned. Timestamps without a zone
+// are parsed as being in loc.
+func detectFormat(samples []extract.Value, loc *time.Location) (timeformat.ParseFunc, error) {
+	texts := []string{}
+	for _, val := range samples {
+		// Numeric values are always epoch values, so they don't say
+		// anything about the format of the textual timestamps.
+		if !val.Numeric {
+			texts = append(texts, val.Text)
+		}
+	}
+	if len(texts) == 0 {
+		fmt.Fprintf(os.Stderr, "No textual timestamps found in the first %d lines, so timestamps will be parsed as epoch values\n", len(samples))
+		return nil, nil
+	}
+
+	d, err := timeformat.DetectFormat(texts)
+	if err != nil {
+		return nil, err
+	}
+	if d.FlagName == "" {
+		fmt.Fprintf(os.Stderr, "Detected timestamps as epoch values, which parses %d of %d sampled timestamps\n", d.Matched, len(texts))
+		return nil, nil
+	}
+	parsefunc, _, err := timeformat.NewDetectedFuncs(d, loc)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Detected timestamp format %q, which parses %d of %d sampled timestamps; equivalent to:\n\n\t%s '%s'\n\n", d.Name, d.Matched, len(texts), d.FlagName, d.Fmt)
+	return parsefunc, nil
+}
+
+// newEpochParseFunc builds the ParseFunc for epoch timestamps in the unit named
+// by unitName, returning it along with the unit. If unitName is "auto" then the
+// unit is guessed from the sampled timestamps and reported on stderr; only
+// Numeric samples are considered unless allSamples is true, which it should be
+// when there's no textual format for the timestamps.
+func newEpochParseFunc(unitName string, samples []extract.Value, allSamples bool) (timeformat.ParseFunc, time.Duration, error) {
+	if strings.ToLower(unitName) != "auto" {
+		unit, err := timeformat.ParseEpochUnit(unitName)
+		if err != nil {
+			return nil, 0, err
+		}
+		return timeformat.MakeParseEpoch(unit), unit, nil
+	}
+	texts := []string{}
+	for _, val := range samples {
+		if val.Numeric || allSamples {
+			texts = append(texts, val.Text)
+		}
+	}
+	unit, err := timeformat.GuessEpochUnit(texts)
+	if err != nil {
+		// With no epoch values to guess from, the unit won't matter unless
+		// the input changes further along, so default to milliseconds.
+		return timeformat.MakeParseEpoch(time.Millisecond), time.Millisecond, nil
+	}
+	parsefunc := timeformat.MakeParseEpoch(unit)
+	example := ""
+	for _, text := range texts {
+		if t, err := parsefunc(text); err == nil {
+			example = fmt.Sprintf(", e.g. %s is %s", text, t.Format(time.RFC3339Nano))
+			break
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Detected epoch timestamps in units of %s%s\n", timeformat.EpochUnitName(unit), example)
+	return parsefunc, unit, nil
+}
+
+// lineOutcome is what became of a line of input.
+type lineOutcome int
+
+const (
+	lineParsed lineOutcome = iota
+	lineBlank
+	lineHeader
+	lineUnmatched
+	lineFailed
+)
+
+// lineParser turns lines of input into timestamps. Extractors and
+// MultiParsers keep state, so each goroutine parsing lines needs its own
+// lineParser.
+type lineParser struct {
+	extractor extract.Extractor
+	// valuer finds the value of each line, when lines aren't just counted.
+	valuer extract.Extractor
+	// grouper finds the key of each line, when lines are grouped.
+	grouper extract.Extractor
+	// ender finds the end of the interval each line describes, when lines
+	// are intervals. If duration is set, it finds the duration of the
+	// interval instead, in units of durationUnit unless given with a unit.
+	ender        extract.Extractor
+	duration     bool
+	durationUnit time.Duration
+	parsefunc    timeformat.ParseFunc
+	epochfunc    timeformat.ParseFunc
+	// precision is the length in nanoseconds of the unit of the timestamps
+	// which lines are turned into.
+	precision int64
+}
+
+// parsedLine is what was found in a line of input.
+type parsedLine struct {
+	// TS is the timestamp of the line, in units of the lineParser's
+	// precision.
+	TS int64
+	// Value is the --value-field of the line, or 1 without one.
+	Value float64
+	// Key is the --group-by key of the line, if lines are grouped.
+	Key string
+	// End is when the interval the line describes ends, if Interval is set.
+	End      int64
+	Interval bool
+}
+
+// addTo adds pl to acc.
+func (pl parsedLine) addTo(acc *tbin.Accumulator) {
+	if pl.Interval {
+		acc.AddInterval(pl.TS, pl.End)
+		return
+	}
+	acc.AddGrouped(pl.Key, pl.TS, pl.Value)
+}
+
+// fields returns the extractors of p which find fields other than the
+// timestamp.
+func (p *lineParser) fields() []extract.Extractor {
+	fields := []extract.Extractor{}
+	for _, x := range []extract.Extractor{p.valuer, p.grouper, p.ender} {
+		if x != nil {
+			fields = append(fields, x)
+		}
+	}
+	return fields
+}
+
+// prime passes the first non-blank line of input through the extractors of
+// p, for a lineParser which will only see lines further along in the input.
+// This lets extractors learn from a header, e.g. which column has a given
+// name.
+func (p *lineParser) prime(first string) {
+	if first == "" {
+		return
+	}
+	if p.extractor != nil {
+		p.extractor.Extract(first)
+	}
+	for _, x := range p.fields() {
+		x.Extract(first)
+	}
+}
+
+// parseLine turns line i of the input named input into a timestamp, along with
+// the value and key of the line. If the outcome is lineFailed then the returned
+// lineFailure says why.
+func (p *lineParser) parseLine(input string, i int, line string) (parsedLine, lineOutcome, lineFailure) {
+	if strings.TrimSpace(line) == "" {
+		return parsedLine{}, lineBlank, lineFailure{}
+	}
+	raw := line
+	numeric := false
+	if p.extractor == nil {
+		line = strings.TrimSpace(line)
+	} else {
+		// Extractors get the untrimmed line since leading and trailing
+		// whitespace may be significant, e.g. an empty first column of
+		// tab-separated input.
+		val, err := p.extractor.Extract(line)
+		if errors.Is(err, extract.ErrHeaderLine) {
+			// The header also says which columns hold the other fields.
+			for _, x := range p.fields() {
+				if _, err := x.Extract(line); err != nil && !errors.Is(err, extract.ErrHeaderLine) {
+					werr := fmt.Errorf("cannot find a column in line %d of %s: %w", i, input, err)
+					return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: line, Err: werr, Cause: err}
+				}
+			}
+			return parsedLine{}, lineHeader, lineFailure{}
+		}
+		if errors.Is(err, extract.ErrNoMatch) {
+			return parsedLine{}, lineUnmatched, lineFailure{}
+		}
+		if err != nil {
+			werr := fmt.Errorf("cannot extract timestamp from line %d of %s: %w", i, input, err)
+			return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: line, Err: werr, Cause: err}
+		}
+		line = strings.TrimSpace(val.Text)
+		numeric = val.Numeric
+	}
+	pf := p.parsefunc
+	if numeric {
+		pf = p.epochfunc
+	}
+	t, err := pf(line)
+	if err != nil {
+		werr := fmt.Errorf("cannot parse line %d of %s to date: %w", i, input, err)
+		return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: line, Err: werr, Cause: err, Unparsed: true}
+	}
+	ts, err := tbin.FromTime(t, p.precision)
+	if err != nil {
+		werr := fmt.Errorf("cannot use timestamp on line %d of %s: %w", i, input, err)
+		return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: line, Err: werr, Cause: err}
+	}
+	value, err := p.weigh(raw)
+	if err != nil {
+		werr := fmt.Errorf("cannot find the value of line %d of %s: %w", i, input, err)
+		return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: raw, Err: werr, Cause: err}
+	}
+	key, err := p.key(raw)
+	if err != nil {
+		werr := fmt.Errorf("cannot find the key of line %d of %s: %w", i, input, err)
+		return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: raw, Err: werr, Cause: err}
+	}
+	pl := parsedLine{TS: ts, Value: value, Key: key}
+	if p.ender != nil {
+		pl.Interval = true
+		pl.End, err = p.end(raw, t)
+		if err != nil {
+			werr := fmt.Errorf("cannot find the end of the interval on line %d of %s: %w", i, input, err)
+			return parsedLine{}, lineFailed, lineFailure{Input: input, Line: i, Sample: raw, Err: werr, Cause: err}
+		}
+	}
+	return pl, lineParsed, lineFailure{}
+}
+
+// weigh returns the value of line, which is its --value-field if there is
+// one.
+func (p *lineParser) weigh(line string) (float64, error) {
+	if p.valuer == nil {
+		return 1, nil
+	}
+	val, err := p.valuer.Extract(line)
+	if errors.Is(err, extract.ErrNoMatch) {
+		return 0, fmt.Errorf("no value found by --value-field %q", *valueField)
+	}
+	if err != nil {
+		return 0, err
+	}
+	weight, err := strconv.ParseFloat(strings.TrimSpace(val.Text), 64)
+	if err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return 0, fmt.Errorf("value %q is not a number", val.Text)
+	}
+	return weight, nil
+}
+
+// end returns the end of the interval starting at start which line
+// describes, found from its --end-field or its --duration-field.
+func (p *lineParser) end(line string, start time.Time) (int64, error) {
+	flagName, name := "--end-field", *endField
+	if p.duration {
+		flagName, name = "--duration-field", *durField
+	}
+	val, err := p.ender.Extract(line)
+	if errors.Is(err, extract.ErrNoMatch) {
+		return 0, fmt.Errorf("nothing found by %s %q", flagName, name)
+	}
+	if err != nil {
+		return 0, err
+	}
+	text := strings.TrimSpace(val.Text)
+	if p.duration {
+		d, err := timeformat.ParseDuration(text, p.durationUnit)
+		if err != nil {
+			return 0, err
+		}
+		if d < 0 {
+			return 0, fmt.Errorf("duration %q is negative", text)
+		}
+		end, err := tbin.FromTime(start.Add(d), p.precision)
+		if err != nil {
+			return 0, fmt.Errorf("duration %q runs past the latest time which can be handled", text)
+		}
+		return end, nil
+	}
+	pf := p.parsefunc
+	if val.Numeric {
+		pf = p.epochfunc
+	}
+	t, err := pf(text)
+	if err != nil {
+		return 0, err
+	}
+	if t.Before(start) {
+		return 0, fmt.Errorf("it ends at %s, before it starts at %s", t.Format(time.RFC3339Nano), start.Format(time.RFC3339Nano))
+	}
+	return tbin.FromTime(t, p.precision)
+}
+
+// key returns the --group-by key of line, if lines are grouped.
+func (p *lineParser) key(line string) (string, error) {
+	if p.grouper == nil {
+		return "", nil
+	}
+	val, err := p.grouper.Extract(line)
+	if errors.Is(err, extract.ErrNoMatch) {
+		return "", fmt.Errorf("no key found by --group-by %q", *groupBy)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(val.Text), nil
+}
+
+// newFailureHandler returns a func which records a line which couldn't be
+// turned into a timestamp in report, returning an error if reading should
+// stop according to policy.
+func newFailureHandler(policy errorPolicy, report *parseReport) func(lineFailure) error {
+	return func(f lineFailure) error {
+		report.addFailure(f.Input, f.Line, f.Sample, f.Cause)
+		if policy.Mode == onErrorFail {
+			if f.Unparsed {
+				fmt.Fprint(os.Stderr, timeformat.GuessTimestampFormat(f.Sample))
+			}
+			return f.Err
+		}
+		if policy.Mode == onErrorWarn {
+			fmt.Fprintf(os.Stderr, "WARNING: skipping line %d of %s: %s\n", f.Line, f.Input, f.Err.Error())
+		}
+		if policy.MaxErrors > 0 && report.Failed > policy.MaxErrors {
+			return fmt.Errorf("giving up after more than %d lines failed to parse, the last being: %w", policy.MaxErrors, f.Err)
+		}
+		return nil
+	}
+}
+
+// read_lines_to_integers attempts to parse each non-empty line of each of files
+// as a time, adding each to acc as soon as it's parsed so that the timestamps
+// needn't all be held in memory. Each integer added to acc represents a count
+// of units of the lineParsers' precision since UNIX epoch. Lines are parsed in
+// chunks by workers goroutines, each with a lineParser from newParser; see
+// lineParser for how each line is handled. Every file gets fresh lineParsers,
+// since e.g. each CSV file starts with its own header. What happened to every
+// line is recorded in the returned parseReport.
+//
+// If a line fails to parse and policy says to fail, then an error is returned.
+// Before returning though, a hint is printed on stderr to the user indicating
+// what that line's timestamp format _should_ have been, via our best guess.
+// Otherwise failing lines are skipped (and with onErrorWarn, reported on stderr
+// as they're found) until policy.MaxErrors is exceeded. Chunks are handled in
+// order, so failures are reported in the order of the lines no matter how many
+// workers there are.
+func read_lines_to_integers(files []*inputFile, newParser func() (*lineParser, error), policy errorPolicy, workers int, acc *tbin.Accumulator) (parseReport, error) {
+	report := parseReport{}
+	fail := newFailureHandler(policy, &report)
+	var ferr error
+	add := func(counts parseReport) {
+		report.Parsed += counts.Parsed
+		report.Blank += counts.Blank
+		report.Headers += counts.Headers
+		report.Unmatched += counts.Unmatched
+		report.LinesRead += counts.LinesRead
+	}
+	handle := func(res chunkResult) bool {
+		for _, f := range res.Failures {
+			if ferr = fail(f); ferr != nil {
+				// The failing line was read, but none after it.
+				add(f.Before)
+				report.LinesRead += 1
+				return false
+			}
+		}
+		add(res.Report)
+		return true
+	}
+	for _, f := range files {
+		if err := f.Open(); err != nil {
+			return report, err
+		}
+		err := parseChunks(newChunkReader(f.Reader(), f.String()), workers, newParser, acc, handle)
+		f.Close()
+		if err != nil {
+			return report, err
+		}
+		if ferr != nil {
+			return report, ferr
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// stdinName is the input argument meaning stdin.
+const stdinName = "-"
+
+// compression is a format in which input files may be compressed, recognized
+// by either the magic bytes at the start of the file or its extension.
+type compression struct {
+	Name       string
+	Magic      []byte
+	Extensions []string
+	NewReader  func(r io.Reader) (io.ReadCloser, error)
+}
+
+var COMPRESSIONS = []compression{
+	{
+		Name:       "gzip",
+		Magic:      []byte{0x1f, 0x8b},
+		Extensions: []string{".gz", ".gzip"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	{
+		Name:       "bzip2",
+		Magic:      []byte("BZh"),
+		Extensions: []string{".bz2", ".bzip2"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(bzip2.NewReader(r)), nil
+		},
+	},
+	{
+		Name:       "zstd",
+		Magic:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+		Extensions: []string{".zst", ".zstd"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	{
+		Name:       "xz",
+		Magic:      []byte{0xfd, '7', 'z', 'X', 'Z', 0x00},
+		Extensions: []string{".xz"},
+		NewReader: func(r io.Reader) (io.ReadCloser, error) {
+			xr, err := xz.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return io.NopCloser(xr), nil
+		},
+	},
+}
+
+// detectCompression returns the compression of the input named name, whose
+// first bytes are head, or nil if it isn't compressed. Compressed input is
+// recognized by its magic bytes, so that e.g. stdin can be compressed, or
+// otherwise by its extension, so that a corrupt file is reported as such
+// rather than read as garbled text.
+func detectCompression(name string, head []byte) *compression {
+	for i, c := range COMPRESSIONS {
+		if bytes.HasPrefix(head, c.Magic) {
+			return &COMPRESSIONS[i]
+		}
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for i, c := range COMPRESSIONS {
+		for _, e := range c.Extensions {
+			if ext == e {
+				return &COMPRESSIONS[i]
+			}
+		}
+	}
+	return nil
+}
+
+// expandInputArgs turns the positional arguments into the names of the
+// inputs to read, expanding glob patterns. No arguments means reading stdin,
+// as does the argument "-".
+func expandInputArgs(args []string) ([]string, error) {
+	if len(args) == 0 {
+		return []string{stdinName}, nil
+	}
+	names := []string{}
+	stdin := false
+	for _, arg := range args {
+		if arg == stdinName {
+			if stdin {
+				return nil, fmt.Errorf("stdin (%q) may only be given once", stdinName)
+			}
+			stdin = true
+			names = append(names, arg)
+			continue
+		}
+		// Files whose names happen to contain glob characters are taken as
+		// they are.
+		if _, err := os.Stat(arg); err == nil || !strings.ContainsAny(arg, "*?[") {
+			names = append(names, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("bad glob pattern %q: %w", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %q", arg)
+		}
+		names = append(names, matches...)
+	}
+	return names, nil
+}
+
+// inputFile is one of the inputs to read timestamps from, which is opened
+// once it's needed.
+type inputFile struct {
+	// Name is the argument naming the input, which is "-" for stdin.
+	Name string
+	// Follow makes reading a file wait for more to be written to it once
+	// the end is reached, following it across rotation, as with tail -F.
+	Follow  bool
+	rdr     io.Reader
+	tail    *tailReader
+	closers []io.Closer
+}
+
+func newInputFiles(names []string) []*inputFile {
+	files := []*inputFile{}
+	for _, name := range names {
+		files = append(files, &inputFile{Name: name})
+	}
+	return files
+}
+
+// String is how the input is referred to in messages.
+func (f *inputFile) String() string {
+	if f.Name == stdinName {
+		return "stdin"
+	}
+	return f.Name
+}
+
+// Open makes f ready to be read from Reader, decompressing it if needed and
+// skipping any byte order mark. Opening an input which is already open does
+// nothing.
+func (f *inputFile) Open() error {
+	if f.rdr != nil {
+		return nil
+	}
+	if f.Follow && f.Name != stdinName {
+		if c := detectCompression(f.Name, nil); c != nil {
+			return fmt.Errorf("cannot follow %s, since it's compressed with %s", f, c.Name)
+		}
+		tr, err := newTailReader(f.Name)
+		if err != nil {
+			return fmt.Errorf("cannot open input: %w", err)
+		}
+		f.closers = append(f.closers, tr)
+		f.tail = tr
+		// Opening an empty file shouldn't wait for it to be written to.
+		tr.stopAtEnd = true
+		f.rdr = skipBOM(tr)
+		tr.stopAtEnd = false
+		return nil
+	}
+	var r io.Reader = os.Stdin
+	if f.Name != stdinName {
+		file, err := os.Open(f.Name)
+		if err != nil {
+			return fmt.Errorf("cannot open input: %w", err)
+		}
+		f.closers = append(f.closers, file)
+		r = file
+	}
+	br := bufio.NewReader(r)
+	head, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return fmt.Errorf("cannot read %s: %w", f, err)
+	}
+	if c := detectCompression(f.Name, head); c != nil {
+		dr, err := c.NewReader(br)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("cannot decompress %s as %s: %w", f, c.Name, err)
+		}
+		f.closers = append(f.closers, dr)
+		r = dr
+	} else {
+		r = br
+	}
+	f.rdr = skipBOM(r)
+	return nil
+}
+
+// Reader returns the reader of an opened f.
+func (f *inputFile) Reader() io.Reader {
+	return f.rdr
+}
+
+// SetReader replaces the reader of an opened f, e.g. with one which yields
+// lines which were already read from it.
+func (f *inputFile) SetReader(r io.Reader) {
+	f.rdr = r
+}
+
+// StopAtEnd sets whether reading a followed f ends once what has been
+// written to it so far is read, rather than waiting for more, e.g. while
+// sampling its first lines. It does nothing to inputs which aren't followed.
+func (f *inputFile) StopAtEnd(stop bool) {
+	if f.tail != nil {
+		f.tail.stopAtEnd = stop
+	}
+}
+
+// Close closes f and any decompressor reading from it.
+func (f *inputFile) Close() error {
+	var first error
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		if err := f.closers[i].Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	f.closers = nil
+	f.tail = nil
+	return first
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testInputText = "1700000000000\n1700000001000\n"
+
+// testInputBzip2 is testInputText compressed with bzip2, for which there's no
+// compressor in the standard library.
+const testInputBzip2 = "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x44\x54\x29\x9a\x00\x00\x08\xc8\x00\x08\x90\x60\x80\x20\x00\x21\x29\xa6\x03\x00\x67\xae\x09\x49\x46\x61\x77\x24\x53\x85\x09\x04\x45\x42\x99\xa0"
+
+// compress returns text compressed with the compression named name.
+func compress(t *testing.T, name, text string) []byte {
+	buf := &bytes.Buffer{}
+	var w io.WriteCloser
+	var err error
+	switch name {
+	case "gzip":
+		w = gzip.NewWriter(buf)
+	case "bzip2":
+		require.Equal(t, testInputText, text, "only testInputText can be compressed with bzip2")
+		return []byte(testInputBzip2)
+	case "zstd":
+		w, err = zstd.NewWriter(buf)
+	case "xz":
+		w, err = xz.NewWriter(buf)
+	default:
+		return []byte(text)
+	}
+	require.NoError(t, err)
+	_, err = w.Write([]byte(text))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestDetectCompression(t *testing.T) {
+	type tcase struct {
+		Name    string
+		Head    []byte
+		ExpName string
+	}
+	for idx, test := range []tcase{
+		{"access.log", []byte("17000000"), ""},
+		{"access.log", nil, ""},
+		{"access.log.gz", nil, "gzip"},
+		{"ACCESS.LOG.GZ", nil, "gzip"},
+		{"access.log.bz2", nil, "bzip2"},
+		{"access.log.zst", nil, "zstd"},
+		{"access.log.xz", nil, "xz"},
+		// The magic bytes win over a misleading extension.
+		{"access.log", []byte{0x1f, 0x8b, 0x08, 0x00}, "gzip"},
+		{"access.log.gz", []byte("BZh91AY&"), "bzip2"},
+		{"access.log.xz", []byte{0x28, 0xb5, 0x2f, 0xfd, 0, 0, 0, 0}, "zstd"},
+		{"-", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0, 0}, "xz"},
+		{"-", []byte("BZ"), ""},
+	} {
+		c := detectCompression(test.Name, test.Head)
+		name := ""
+		if c != nil {
+			name = c.Name
+		}
+		require.Equal(t, test.ExpName, name, "for test #%d", idx)
+	}
+}
+
+func TestInputFileOpen(t *testing.T) {
+	type tcase struct {
+		Name        string
+		Compression string
+		Text        string
+		ExpText     string
+		// ExpErr is a substring of the error opening or reading the file.
+		ExpErr string
+	}
+	for _, test := range []tcase{
+		{Name: "plain.log", Text: testInputText, ExpText: testInputText},
+		{Name: "empty.log", Text: "", ExpText: ""},
+		{Name: "bom.log", Text: utf8BOM + testInputText, ExpText: testInputText},
+		{Name: "a.log.gz", Compression: "gzip", Text: testInputText, ExpText: testInputText},
+		{Name: "a.log.bz2", Compression: "bzip2", Text: testInputText, ExpText: testInputText},
+		{Name: "a.log.zst", Compression: "zstd", Text: testInputText, ExpText: testInputText},
+		{Name: "a.log.xz", Compression: "xz", Text: testInputText, ExpText: testInputText},
+		{Name: "bom.log.gz", Compression: "gzip", Text: utf8BOM + testInputText, ExpText: testInputText},
+		// Compressed files are recognized by their contents whatever
+		// they're called.
+		{Name: "gzip.log", Compression: "gzip", Text: testInputText, ExpText: testInputText},
+		{Name: "zstd.log.bz2", Compression: "zstd", Text: testInputText, ExpText: testInputText},
+		{Name: "xz", Compression: "xz", Text: testInputText, ExpText: testInputText},
+		// A file which is named as compressed but isn't is reported rather
+		// than read as garbled text.
+		{Name: "plain.log.gz", Text: testInputText, ExpErr: "plain.log.gz as gzip"},
+		{Name: "plain.log.xz", Text: testInputText, ExpErr: "plain.log.xz as xz"},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.Name)
+			require.NoError(t, os.WriteFile(path, compress(t, test.Compression, test.Text), 0o644))
+			f := newInputFiles([]string{path})[0]
+			err := f.Open()
+			if test.ExpErr != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), test.ExpErr)
+				return
+			}
+			require.NoError(t, err)
+			// Opening it again does nothing.
+			require.NoError(t, f.Open())
+			got, err := io.ReadAll(f.Reader())
+			require.NoError(t, err)
+			require.Equal(t, test.ExpText, string(got))
+			require.NoError(t, f.Close())
+		})
+	}
+
+	f := newInputFiles([]string{filepath.Join(t.TempDir(), "missing.log")})[0]
+	require.Error(t, f.Open())
+}
+
+func TestExpandInputArgs(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.log", "b.log", "c.txt", "[weird].log"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(testInputText), 0o644))
+	}
+	in := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	type tcase struct {
+		Args     []string
+		ExpNames []string
+		// ExpErr is a substring of the error, if the args are rejected.
+		ExpErr string
+	}
+	for idx, test := range []tcase{
+		{Args: nil, ExpNames: []string{"-"}},
+		{Args: []string{"-"}, ExpNames: []string{"-"}},
+		{Args: []string{in("c.txt"), "-"}, ExpNames: []string{in("c.txt"), "-"}},
+		{Args: []string{in("*.log")}, ExpNames: []string{in("[weird].log"), in("a.log"), in("b.log")}},
+		{Args: []string{in("?.*"), "-"}, ExpNames: []string{in("a.log"), in("b.log"), in("c.txt"), "-"}},
+		// Files which exist are taken as they are, even if their names look
+		// like glob patterns.
+		{Args: []string{in("[weird].log")}, ExpNames: []string{in("[weird].log")}},
+		// Files which don't exist are left to be reported when opened.
+		{Args: []string{in("missing.log")}, ExpNames: []string{in("missing.log")}},
+		{Args: []string{"-", in("a.log"), "-"}, ExpErr: `stdin ("-") may only be given once`},
+		{Args: []string{in("*.csv")}, ExpErr: "no files match"},
+		{Args: []string{in("[.log")}, ExpErr: "bad glob pattern"},
+	} {
+		names, err := expandInputArgs(test.Args)
+		if test.ExpErr != "" {
+			require.Error(t, err, "for test #%d", idx)
+			require.Contains(t, err.Error(), test.ExpErr, "for test #%d", idx)
+			continue
+		}
+		require.NoError(t, err, "for test #%d", idx)
+		require.Equal(t, test.ExpNames, names, "for test #%d", idx)
+	}
+}
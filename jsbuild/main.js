@@ -58,22 +58,92 @@ const panStatus = () => zoomOptions.pan.enabled ? 'enabled' : 'disabled';
 const zoomStatus = () => zoomOptions.zoom.drag.enabled ? 'enabled' : 'disabled';
 
 
-const LABEL_LOCALTZ = 'Timeseries #1 - Local time zone ('+Intl.DateTimeFormat().resolvedOptions().timeZone+')';
-const LABEL_UTC = 'Timeseries #1 - UTC';
+// Bins may have been aligned in a different zone than the one they're shown
+// in, so say which zone that was.
+const BIN_TZ_NOTE = CONTEXT.bin_tz ? ', bins aligned in ' + CONTEXT.bin_tz : '';
+const LABEL_LOCALTZ = 'Local time zone ('+Intl.DateTimeFormat().resolvedOptions().timeZone+')' + BIN_TZ_NOTE;
+const LABEL_UTC = 'UTC' + BIN_TZ_NOTE;
+// tzLabel is the label of the time zone the bins are being shown in.
+let tzLabel = LABEL_LOCALTZ;
 
-const LINE_COLOR = 'rgb(54, 162, 235)';
+// Each --agg of each --group-by key is its own dataset, drawn in the next of
+// these colors.
+const COLORS = [
+    'rgb(54, 162, 235)',
+    'rgb(255, 99, 132)',
+    'rgb(255, 159, 64)',
+    'rgb(75, 192, 192)',
+    'rgb(153, 102, 255)',
+    'rgb(255, 205, 86)',
+    'rgb(46, 139, 87)',
+    'rgb(199, 21, 133)',
+    'rgb(128, 128, 0)',
+    'rgb(0, 0, 128)',
+    'rgb(201, 203, 207)',
+];
+// The bars of several datasets in a bin are either stacked on top of each
+// other, grouped side by side, or overlaid in front of each other.
+let barMode = 'stacked';
+const GAP_COLOR = 'rgba(128, 128, 128, 0.15)';
 
-const data = {
-    datasets: [
-        {
-            label: LABEL_LOCALTZ,
-            data: CONTEXT.data,
-            borderColor: LINE_COLOR,
-            backgroundColor: LINE_COLOR,
-            barPercentage: 0.99,
-            categoryPercentage: 0.9,
+// With --sparse, runs of empty bins are left out of the data and replaced by
+// a single datapoint with a "gap" and no value. Shade those so the gaps stand
+// out, since otherwise the bins on either side would look adjacent.
+const gapShading = {
+    id: 'gapShading',
+    beforeDatasetsDraw(chart) {
+        if (chart.data.datasets.length == 0) {
+            return;
+        }
+        const points = chart.data.datasets[0].data;
+        const xscale = chart.scales.x;
+        const area = chart.chartArea;
+        const c = chart.ctx;
+        c.save();
+        c.fillStyle = GAP_COLOR;
+        for (let i = 0; i < points.length; i++) {
+            if (!points[i].gap) {
+                continue;
+            }
+            // Shade the gap's slot, which runs halfway to its neighbours.
+            const x = xscale.getPixelForValue(points[i].x);
+            const prev = i > 0 ? xscale.getPixelForValue(points[i - 1].x) : x;
+            const next = i < points.length - 1 ? xscale.getPixelForValue(points[i + 1].x) : x;
+            const left = Math.max((x + prev) / 2, area.left);
+            const right = Math.min((x + next) / 2, area.right);
+            if (right > left) {
+                c.fillRect(left, area.top, right - left, area.bottom - area.top);
+            }
         }
-    ],
+        c.restore();
+    },
+};
+const gapCount = () => CONTEXT.datasets.length > 0 ? CONTEXT.datasets[0].data.filter((p) => p.gap).length : 0;
+
+// Counts and sums add up across a bin, as does the number of intervals
+// active in it, so they're drawn as bars, while the other aggregates
+// describe the typical or extreme value in a bin, such as the peak number of
+// intervals active at once, and are drawn as lines.
+const isBarAggregate = (agg) => agg == 'count' || agg == 'sum' || agg == 'active';
+// When counts are shown along with aggregates of values they're on a scale of
+// their own, on the right.
+const countAxis = () => CONTEXT.datasets.length > 1 && CONTEXT.datasets.some((ds) => ds.aggregate != 'count');
+const axisFor = (agg) => agg == 'count' && countAxis() ? 'count' : 'y';
+// The y axis says what's being shown: counts of timestamps, or e.g. the p95
+// of a value found along with each one.
+const yLabels = () => [...new Set(CONTEXT.datasets.filter((ds) => axisFor(ds.aggregate) == 'y').map((ds) => ds.label))];
+// With --group-by the legend names the key of each dataset, and only says
+// what's being shown if that differs between datasets.
+function legendLabel(ds) {
+    if (!ds.series) {
+        return ds.label;
+    }
+    const aggs = new Set(CONTEXT.datasets.map((d) => d.aggregate));
+    return aggs.size > 1 ? ds.series + ': ' + ds.label : ds.series;
+}
+
+const data = {
+    datasets: CONTEXT.datasets.map((ds, i) => datasetFor(i)),
 };
 
 const config = {
@@ -91,6 +161,17 @@ const config = {
             x: {
                 type: 'timeseries',
                 time: {unit: CONTEXT.unit},
+                title: {display: true, text: tzLabel},
+            },
+            y: {
+                title: {display: true, text: yLabels().join(', ')},
+            },
+            count: {
+                display: 'auto',
+                position: 'right',
+                beginAtZero: true,
+                grid: {drawOnChartArea: false},
+                title: {display: true, text: 'count'},
             },
         },
         plugins: {
@@ -99,61 +180,109 @@ const config = {
                 display: true,
                 position: 'bottom',
                 text: (ctx) => 'Zoom: (click and drag)' + zoomStatus() + ', Pan (ctrl + click and drag): ' + panStatus()
+                    + (gapCount() > 0 ? ', ' + gapCount() + ' runs of empty bins are shaded grey' : '')
             }
         },
     },
+    plugins: [gapShading],
 };
 
 const ctx = document.getElementById('myChart').getContext('2d');
 const myChart = new Chart(ctx, config);
+showDatasets(myChart);
 function convertDateToUTC(date_) {
     return new Date(date_.getUTCFullYear(), date_.getUTCMonth(), date_.getUTCDate(), date_.getUTCHours(), date_.getUTCMinutes(), date_.getUTCSeconds());
 }
+function subSecondMillis(x) {
+    return x - Math.floor(x / 1000) * 1000;
+}
+// datasetFor builds the chart dataset of CONTEXT.datasets[i], shown in the
+// time zone of tzLabel.
+function datasetFor(i) {
+    const ds = CONTEXT.datasets[i];
+    let points = ds.data;
+    if (tzLabel == LABEL_UTC) {
+        points = [];
+        for (var j = 0; j < ds.data.length; j++) {
+            points.push({
+                // Date only has whole seconds here, so add back the
+                // (possibly fractional) milliseconds of sub-second bins.
+                x: convertDateToUTC(new Date(ds.data[j].x)).getTime() + subSecondMillis(ds.data[j].x),
+                y: ds.data[j].y,
+                gap: ds.data[j].gap,
+            });
+        }
+    }
+    const color = COLORS[i % COLORS.length];
+    const bar = isBarAggregate(ds.aggregate);
+    return {
+        type: bar ? 'bar' : 'line',
+        label: legendLabel(ds),
+        data: points,
+        yAxisID: axisFor(ds.aggregate),
+        // Bars of the same aggregate stack on each other, but lines are
+        // never stacked, since e.g. adding up the p95 of each key means
+        // nothing.
+        stack: bar ? ds.aggregate : 'line' + i,
+        borderColor: color,
+        // Overlaid bars are see-through, so those behind still show.
+        backgroundColor: bar && barMode == 'overlaid' ? color.replace('rgb', 'rgba').replace(')', ', 0.4)') : color,
+        pointRadius: 1,
+        barPercentage: 0.99,
+        categoryPercentage: 0.9,
+    };
+}
+// showDatasets rebuilds the datasets of chart from CONTEXT, keeping any which
+// were hidden by clicking on the legend hidden.
+function showDatasets(chart, mode) {
+    const hidden = new Set(chart.data.datasets.filter((ds, i) => !chart.isDatasetVisible(i)).map((ds) => ds.label));
+    chart.data.datasets = CONTEXT.datasets.map((ds, i) => {
+        const d = datasetFor(i);
+        d.hidden = hidden.has(d.label);
+        return d;
+    });
+    const scales = chart.options.scales;
+    scales.x.title.text = tzLabel;
+    scales.y.title.text = yLabels().join(', ');
+    scales.x.stacked = barMode != 'grouped';
+    scales.y.stacked = barMode == 'stacked';
+    scales.count.stacked = barMode == 'stacked';
+    chart.update(mode);
+}
+// setBarMode returns an action showing the bars of chart in the given mode.
+function setBarMode(mode, name) {
+    return {
+        name: name,
+        handler(chart) {
+            barMode = mode;
+            showDatasets(chart);
+        },
+    };
+}
 const actions = [
     {
         name: "Set TZ to local timezone",
         handler(chart) {
-            let exp_label = LABEL_LOCALTZ;
-            if (chart.data.datasets[0].label == exp_label) {
+            if (tzLabel == LABEL_LOCALTZ) {
                 return;
             }
-            chart.data.datasets[0] = {
-                label: exp_label,
-                data: CONTEXT.data,
-                borderColor: LINE_COLOR,
-                backgroundColor: LINE_COLOR,
-                barPercentage: 0.99,
-                categoryPercentage: 0.9,
-            };
-            chart.update();
+            tzLabel = LABEL_LOCALTZ;
+            showDatasets(chart);
         },
     },
     {
         name: "Set TZ to UTC",
         handler(chart) {
-            let exp_label = LABEL_UTC;
-            if (chart.data.datasets[0].label == exp_label) {
+            if (tzLabel == LABEL_UTC) {
                 return;
             }
-            var nd = [];
-            for (var i = 0; i < CONTEXT.data.length; i++) {
-                nd.push({
-                    x: convertDateToUTC(new Date(CONTEXT.data[i].x)).getTime(),
-                    y: CONTEXT.data[i].y,
-                });
-            }
-            console.log(nd);
-            chart.data.datasets[0] = {
-                label: exp_label,
-                data: nd,
-                borderColor: LINE_COLOR,
-                backgroundColor: LINE_COLOR,
-                barPercentage: 0.99,
-                categoryPercentage: 0.9,
-            };
-            chart.update();
+            tzLabel = LABEL_UTC;
+            showDatasets(chart);
         },
     },
+    setBarMode('stacked', 'Stack bars'),
+    setBarMode('grouped', 'Group bars side by side'),
+    setBarMode('overlaid', 'Overlay bars'),
     {
         name: 'Reset zoom',
         handler(chart) {
@@ -169,3 +298,89 @@ actions.forEach((a, i) => {
   button.onclick = () => a.handler(myChart);
   document.querySelector(".buttons").appendChild(button);
 });
+
+// Show how much of the input made it into the chart, so that viewers know
+// if data was dropped because it couldn't be parsed.
+function renderReport(report) {
+  if (typeof report === 'undefined' || report === null) {
+    return;
+  }
+  const section = document.querySelector(".report");
+  section.innerHTML = '';
+  section.classList.remove("has-skipped");
+  const skipped = report.unmatched + report.failed;
+  let summary = 'Read ' + report.lines_read + ' lines: ' + report.parsed + ' parsed, '
+    + report.blank + ' blank, ' + skipped + ' skipped';
+  if (skipped > 0) {
+    summary += ' (' + report.unmatched + ' without a timestamp, ' + report.failed + ' failed to parse)';
+    section.classList.add("has-skipped");
+  }
+  const p = document.createElement("div");
+  p.innerText = summary;
+  section.appendChild(p);
+  if (report.layouts) {
+    const layouts = document.createElement("div");
+    layouts.innerText = 'Lines matched by each layout: ' + report.layouts.map(
+      (lc) => lc.layout.flag + " '" + lc.layout.fmt + "': " + lc.matched
+    ).join(', ');
+    section.appendChild(layouts);
+  }
+  if (!report.failures || report.failures.length == 0) {
+    return;
+  }
+  const list = document.createElement("ul");
+  report.failures.forEach((f) => {
+    const item = document.createElement("li");
+    item.innerText = 'line ' + f.line + ' of ' + f.input + ': ' + JSON.stringify(f.sample) + ': ' + f.error;
+    list.appendChild(item);
+  });
+  if (report.failed > report.failures.length) {
+    const item = document.createElement("li");
+    item.innerText = '... and ' + (report.failed - report.failures.length) + ' more failed lines';
+    list.appendChild(item);
+  }
+  section.appendChild(list);
+}
+renderReport(REPORT);
+
+// mergeData updates each of CONTEXT.datasets with points for bins which are
+// new or whose values changed, keeping them in order.
+function mergeData(datasets) {
+  datasets.forEach((ds, i) => {
+    const data = CONTEXT.datasets[i].data;
+    const index = new Map(data.map((p, j) => [p.x, j]));
+    let added = false;
+    ds.data.forEach((p) => {
+      if (index.has(p.x)) {
+        data[index.get(p.x)] = p;
+      } else {
+        data.push(p);
+        added = true;
+      }
+    });
+    if (added) {
+      data.sort((a, b) => a.x - b.x);
+    }
+  });
+}
+
+// With --follow, the server pushes bins as timestamps are read so that the
+// chart grows without reloading the page. A "reset" gives every bin, and an
+// "update" only those which changed.
+if (LIVE) {
+  const events = new EventSource('/events');
+  const show = (msg) => {
+    showDatasets(myChart, 'none');
+    renderReport(msg.report);
+  };
+  events.addEventListener('reset', (e) => {
+    const msg = JSON.parse(e.data);
+    CONTEXT.datasets = msg.context.datasets;
+    show(msg);
+  });
+  events.addEventListener('update', (e) => {
+    const msg = JSON.parse(e.data);
+    mergeData(msg.datasets);
+    show(msg);
+  });
+}
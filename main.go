@@ -1,9 +1,9 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
@@ -12,14 +12,17 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"time"
+	// Embed the IANA time zone database so that --input-tz works even on
+	// systems which don't have one installed.
+	_ "time/tzdata"
 
 	timefmt "github.com/itchyny/timefmt-go"
 	isatty "github.com/mattn/go-isatty"
 	"github.com/spf13/pflag"
 
+	"github.com/lelandbatey/histogram_timestamps/extract"
 	"github.com/lelandbatey/histogram_timestamps/tbin"
 	"github.com/lelandbatey/histogram_timestamps/timeformat"
 )
@@ -28,9 +31,37 @@ var (
 	outputpath   = pflag.StringP("output-path", "o", "./", "Path to the directory to write out the HTML file visualizing the timeseries data")
 	title        = pflag.StringP("title", "t", "Timeseries data", "Title of the generated HTML page")
 	generateData = pflag.BoolP("generate-fake-data", "g", false, "If provided, all the program will do is generate a bunch of fake timestamps and print them on stdout. Useful as a way to feed known input to another histogram_timestamps")
-	unit         = pflag.StringP("unit", "u", "auto", "The duration of each 'bin' to group timestamps into: https://pandas.pydata.org/pandas-docs/stable/user_guide/timeseries.html#offset-aliases")
-	strptimefmt  = pflag.StringP("strptime-fmt", "f", "", "A strptime-compatible date format specifier. Use if your data isn't formatted as integer milliseconds since epoch.")
-	gotimefmt    = pflag.StringP("gotime-fmt", "", "", "A go time compatible date format specifier. Use if your data isn't formatted as integer milliseconds since epoch.")
+	unit         = pflag.StringP("unit", "u", "auto", "The duration of each 'bin' to group timestamps into: https://pandas.pydata.org/pandas-docs/stable/user_guide/timeseries.html#offset-aliases. Note that 'M' is a calendar month while 'm' is a minute; months (M), quarters (Q), and years (Y) follow calendar boundaries. Compound durations such as '1h30m' or '1.5h' and ISO-8601 durations such as 'PT90M' are also accepted. Use 'auto' to pick a round size giving about --target-bins bins, or 'fd' to pick one with the Freedman-Diaconis rule.")
+	targetBins   = pflag.IntP("target-bins", "", tbin.DEFAULT_TARGET_BINS, "The number of bins to aim for with '--unit auto'.")
+	maxBins      = pflag.Int64P("max-bins", "", 100000, "Fail rather than draw more than this many bins, which one stray timestamp far from the rest can cause when every empty bin is filled in. Zero means no limit. Doesn't apply with --sparse.")
+	sparse       = pflag.BoolP("sparse", "", false, "If provided, leave empty bins out of the chart, marking where runs of them were left out instead.")
+	clipPct      = pflag.Float64P("clip-percentile", "", 0, "Drop timestamps below this percentile and above 100 minus this percentile before binning, e.g. 0.1 to ignore the earliest and latest 0.1% as outliers.")
+	strptimefmt  = pflag.StringArrayP("strptime-fmt", "f", nil, "A strptime-compatible date format specifier. Use if your data isn't formatted as integer milliseconds since epoch. May be repeated if timestamps come in several formats; each is tried in turn, after any --gotime-fmt.")
+	gotimefmt    = pflag.StringArrayP("gotime-fmt", "", nil, "A go time compatible date format specifier. Use if your data isn't formatted as integer milliseconds since epoch. May be repeated if timestamps come in several formats; each is tried in turn.")
+	extractRegex = pflag.StringP("extract-regex", "", "", "A regular expression used to find the timestamp within each line. The capture group named 'ts' is used if present, otherwise the first capture group, otherwise the whole match. Lines which don't match are counted and skipped.")
+	delimiter    = pflag.StringP("delimiter", "d", "", "The character separating the fields of CSV/TSV style input; use '\\t' or 'tab' for tabs. Defaults to ',' when --field is provided.")
+	field        = pflag.StringP("field", "", "", "The field of delimited input which holds the timestamp, as a 1-based column index or, when used with --header, a column name.")
+	header       = pflag.BoolP("header", "", false, "If provided, the first line of delimited input is a header naming the columns rather than data.")
+	jsonPath     = pflag.StringP("json-path", "", "", "For JSON-per-line input, the path to the field holding the timestamp, e.g. '.request.ts' or 'events[0].time'. JSON numbers are epoch values, JSON strings are parsed per --strptime-fmt/--gotime-fmt.")
+	autoFormat   = pflag.BoolP("auto-format", "a", false, "If provided, detect the format of the timestamps by sampling the first lines of input, then parse all input with the format which fits the most of the sampled lines. With --follow, only the lines already in the file are sampled.")
+	autoLines    = pflag.IntP("auto-format-lines", "", 1000, "The number of lines to sample when using --auto-format or '--epoch-unit auto'.")
+	onError      = pflag.StringP("on-error", "", "fail", "What to do with lines whose timestamp can't be parsed: 'fail' to stop, 'skip' to leave them out, or 'warn' to leave them out and print a warning for each.")
+	maxErrors    = pflag.IntP("max-errors", "", 0, "With '--on-error skip' or '--on-error warn', stop once more than this many lines have failed to parse. Zero means no limit.")
+	inputTZ      = pflag.StringP("input-tz", "", "UTC", "The time zone of timestamps which don't include a zone or offset, as an IANA name like 'America/Los_Angeles' or an offset like '-08:00'. Timestamps which include an offset keep it.")
+	binTZ        = pflag.StringP("bin-tz", "", "UTC", "The time zone in which to align bins, as an IANA name like 'America/Los_Angeles' or an offset like '-08:00', so that e.g. day bins start at local midnight.")
+	binOrigin    = pflag.StringP("bin-origin", "", "", "A timestamp on which a bin boundary falls, or 'start' or 'end' to align bins to the first or last timestamp. By default bins are aligned to 1970-01-01 in --bin-tz, and calendar bins to the start of the year.")
+	binOffset    = pflag.StringP("bin-offset", "", "", "A duration such as '5m' or '-1h' by which to move every bin boundary, e.g. '--unit 15m --bin-offset 5m' makes bins start at :05, :20, :35, and :50.")
+	weekStart    = pflag.StringP("week-start", "", "mon", "The day on which week bins start, either 'mon' or 'sun'.")
+	follow       = pflag.BoolP("follow", "F", false, "If provided, keep reading the input as it grows, following a file across log rotation like 'tail -F', and update the chart in the browser as timestamps arrive. Needs a single input and a fixed --unit such as '1m'.")
+	valueField   = pflag.StringP("value-field", "", "", "A number found in each line to aggregate per bin per --agg, e.g. a count of bytes or a latency. It's found the same way as the timestamp: a column with --field, a path with --json-path, or a capture group name or number of --extract-regex.")
+	aggFlags     = pflag.StringArrayP("agg", "", nil, "What to show for each bin: 'count' of lines, or the 'sum', 'min', 'max', 'mean', or a percentile such as 'p95' of --value-field. May be repeated to show several, each as its own series. Defaults to 'sum' with --value-field, else 'count'.")
+	groupBy      = pflag.StringP("group-by", "", "", "A field of each line to group lines by, drawing a series for each distinct key, e.g. the name of a service. It's found the same way as --value-field.")
+	maxSeries    = pflag.IntP("max-series", "", 10, "The most series to draw with --group-by; the lines of the keys with the fewest lines are drawn together as 'other'. Zero means no limit.")
+	endField     = pflag.StringP("end-field", "", "", "A field of each line holding the end of an interval which starts at the timestamp, e.g. of a request or a job, to chart how many intervals were active in each bin and the peak number active at once. It's found the same way as --value-field, and parsed the same way as the timestamp.")
+	durField     = pflag.StringP("duration-field", "", "", "Like --end-field, but the field holds the duration of the interval, either a number of --duration-unit or with a unit of its own, such as '1.5s'.")
+	durationUnit = pflag.StringP("duration-unit", "", "ms", "The unit of the numbers in --duration-field, one of s, ms, us, or ns.")
+	workers      = pflag.IntP("workers", "", runtime.GOMAXPROCS(0), "The number of goroutines parsing timestamps in parallel.")
+	epochUnit    = pflag.StringP("epoch-unit", "", "ms", "The unit of epoch timestamps, one of s, ms, us, ns, or 'auto' to infer the unit from the magnitude of the first timestamps. Fractional values such as 1699999999.123456 are allowed.")
 	helpFlag     = pflag.BoolP("help", "h", false, "Print usage and exit")
 )
 
@@ -42,12 +73,19 @@ func smax(v interface{}, l int) string {
 	return s[:l]
 }
 
+func firstOrEmpty(ss []string) string {
+	if len(ss) == 0 {
+		return ""
+	}
+	return ss[0]
+}
+
 func PrintUsage() {
 	// This copy-paste of the code from pflag.Usage() is done so we can
 	// wrap our usage messages automatically.
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage of %s: [flags] [file or glob ...]\n\nTimestamps are read from each file, or from stdin if no files are named or a file is\n'-'. Files compressed with gzip, bzip2, zstd, or xz are decompressed automatically.\n\n", os.Args[0])
 	usages := pflag.CommandLine.FlagUsagesWrapped(90)
-	fmt.Fprintf(os.Stderr, usages)
+	fmt.Fprint(os.Stderr, usages)
 	fmt.Fprintf(os.Stderr, `
 Examples:
 
@@ -60,7 +98,28 @@ Examples:
 	# Parse timestamps in a custom format
 	$ cat /tmp/file_with_timestamps | %s --strptime-fmt "%%Y-%%m-%%dT%%H:%%M:%%S.%%f"
 
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+	# Pull the timestamp out of the middle of each log line
+	$ cat /var/log/app.log | %s --extract-regex 'time=(\S+)' --gotime-fmt '2006-01-02T15:04:05Z07:00'
+
+	# Graph the 'created_at' column of a CSV export
+	$ cat export.csv | %s --header --field created_at --strptime-fmt "%%Y-%%m-%%d %%H:%%M:%%S"
+
+	# Graph a field of JSON-per-line structured logs
+	$ cat app.jsonl | %s --json-path .request.ts --gotime-fmt '2006-01-02T15:04:05Z07:00'
+
+	# Parse timestamps which come in either of two formats
+	$ cat /tmp/mixed_timestamps | %s --gotime-fmt '2006-01-02T15:04:05Z07:00' --strptime-fmt "%%Y-%%m-%%d %%H:%%M:%%S"
+
+	# Let the format of the timestamps be figured out automatically
+	$ cat /tmp/file_with_timestamps | %s --auto-format
+
+	# Graph a log along with its rotated and compressed predecessors
+	$ %s --auto-format /var/log/app.log '/var/log/app.log.*.gz'
+
+	# Graph how many jobs were running at once, from when each started and finished
+	$ cat jobs.csv | %s --header --field started_at --end-field finished_at --auto-format
+
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 
 func main() {
@@ -76,16 +135,16 @@ func main() {
 			os.Exit(2)
 		}
 		for _, ts := range tss {
-			if *strptimefmt != "" {
-				fmt.Printf("%s\n", timefmt.Format(time.UnixMilli(ts).UTC(), *strptimefmt))
+			if len(*strptimefmt) > 0 {
+				fmt.Printf("%s\n", timefmt.Format(tbin.ToTime(ts, tbin.DEFAULT_PRECISION), (*strptimefmt)[0]))
 			} else {
 				fmt.Printf("%d\n", ts)
 			}
 		}
 		os.Exit(0)
 	}
-	if isatty.IsTerminal(os.Stdin.Fd()) {
-		fmt.Printf("You must pipe the timestamps into this program\non stdin; since stdin is a terminal, exiting.\n")
+	if pflag.NArg() == 0 && isatty.IsTerminal(os.Stdin.Fd()) {
+		fmt.Printf("You must pipe the timestamps into this program on stdin\nor name files to read; since stdin is a terminal, exiting.\n")
 		fmt.Printf(`
     HINT: to see an example interactive graph, run the following command
 
@@ -96,46 +155,350 @@ func main() {
 		os.Exit(1)
 	}
 
-	parsefunc, _, err := timeformat.NewFuncs(*strptimefmt, *gotimefmt)
+	// Each goroutine parsing lines gets its own extractor, so this one only
+	// checks that the flags make sense.
+	_, err := newExtractor()
+	if err != nil {
+		fmt.Printf("cannot figure out how to find timestamps in the input: %q\n", err.Error())
+		os.Exit(1)
+	}
+	if _, err := newValueExtractor(); err != nil {
+		fmt.Printf("cannot figure out how to find values in the input: %q\n", err.Error())
+		os.Exit(1)
+	}
+	if _, err := newGroupExtractor(); err != nil {
+		fmt.Printf("cannot figure out how to find the keys to group by in the input: %q\n", err.Error())
+		os.Exit(1)
+	}
+	if *maxSeries < 0 {
+		fmt.Printf("--max-series must not be negative\n")
+		os.Exit(1)
+	}
+	aggs, err := newAggregates()
+	if err != nil {
+		fmt.Printf("invalid --agg: %q\n", err.Error())
+		os.Exit(1)
+	}
+	// In interval mode each line is an interval rather than a timestamp, and
+	// the chart shows how many were active in each bin.
+	intervals := *endField != "" || *durField != ""
+	if *endField != "" && *durField != "" {
+		fmt.Printf("only one of --end-field and --duration-field may be given\n")
+		os.Exit(1)
+	}
+	if intervals && (*follow || *groupBy != "" || *valueField != "" || len(*aggFlags) > 0) {
+		fmt.Printf("--end-field and --duration-field cannot be used with --follow, --group-by, --value-field, or --agg\n")
+		os.Exit(1)
+	}
+	durUnit, err := timeformat.ParseEpochUnit(*durationUnit)
+	if err != nil {
+		fmt.Printf("invalid --duration-unit: %q\n", err.Error())
+		os.Exit(1)
+	}
+	if _, _, err := newEndExtractor(); err != nil {
+		fmt.Printf("cannot figure out how to find the ends of intervals in the input: %q\n", err.Error())
+		os.Exit(1)
+	}
+
+	policy, err := newErrorPolicy(*onError, *maxErrors)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
+	names, err := expandInputArgs(pflag.Args())
+	if err != nil {
+		fmt.Printf("cannot find the input files: %q\n", err.Error())
+		os.Exit(1)
+	}
+	files := newInputFiles(names)
+	if *follow {
+		if len(files) != 1 {
+			fmt.Printf("--follow can only follow a single input, not %d\n", len(files))
+			os.Exit(1)
+		}
+		files[0].Follow = true
+	}
+	var samples []extract.Value
+	if *autoFormat || strings.ToLower(*epochUnit) == "auto" {
+		// Formats are guessed from the first input alone.
+		err := files[0].Open()
+		if err == nil {
+			// Only what's already in a followed file is sampled, since more
+			// lines may be a long time coming.
+			files[0].StopAtEnd(true)
+			var r io.Reader
+			samples, r, err = sampleInput(files[0].Reader(), *autoLines)
+			files[0].StopAtEnd(false)
+			files[0].SetReader(r)
+		}
+		if err != nil {
+			fmt.Printf("cannot read the first lines of input: %q\n", err.Error())
+			os.Exit(2)
+		}
+	}
+
+	inputLoc, err := timeformat.ParseLocation(*inputTZ)
+	if err != nil {
+		fmt.Printf("invalid --input-tz: %q\n", err.Error())
+		os.Exit(1)
+	}
+
+	// parsefunc stays nil when the timestamps are epoch values.
+	var parsefunc timeformat.ParseFunc
+	// multiparser is only used when there are several layouts to try.
+	var multiparser *timeformat.MultiParser
+	if nfmts := len(*strptimefmt) + len(*gotimefmt); nfmts > 0 {
+		if *autoFormat {
+			fmt.Printf("--auto-format cannot be combined with --strptime-fmt or --gotime-fmt\n")
+			os.Exit(1)
+		}
+		if nfmts == 1 {
+			parsefunc, _, err = timeformat.NewFuncs(firstOrEmpty(*strptimefmt), firstOrEmpty(*gotimefmt), inputLoc)
+		} else {
+			multiparser, err = timeformat.NewMultiParser(*strptimefmt, *gotimefmt, inputLoc)
+			if multiparser != nil {
+				parsefunc = multiparser.Parse
+			}
+		}
+		if err != nil {
+			fmt.Printf("cannot figure out how to parse the timestamps: %q\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *autoFormat {
+		parsefunc, err = detectFormat(samples, inputLoc)
+		if err != nil {
+			fmt.Printf("cannot automatically detect the format of the timestamps: %q\n", err.Error())
+			os.Exit(2)
+		}
+	}
+	epochfunc, epochUnitDur, err := newEpochParseFunc(*epochUnit, samples, parsefunc == nil)
 	if err != nil {
-		fmt.Printf("cannot figure out how to parse the ")
+		fmt.Printf("cannot figure out how to parse epoch timestamps: %q\n", err.Error())
+		os.Exit(1)
+	}
+	if parsefunc == nil {
+		parsefunc = epochfunc
 	}
 
 	// 1. read stdin for lines of text
-	// 2. Attempt to parse lines of text into dates then into epoch_ms formats
+	// 2. Attempt to parse lines of text into dates then into epoch timestamps
 	// 3. Bin each timestamp by the interval
 	// 4. Assemble the JSON data to be graphed
 	// 5. Render the HTML/JS+JSON data to a tmp file
 	// 6. Serve the tmp file from a port
 	// 7. Launch a web-browser to view the localhost port
 
-	tss, err := read_lines_to_integers(os.Stdin, parsefunc)
+	binLoc, err := timeformat.ParseLocation(*binTZ)
 	if err != nil {
-		fmt.Printf("cannot divide timestamps into bins: %q", err.Error())
-		os.Exit(2)
+		fmt.Printf("invalid --bin-tz: %q\n", err.Error())
+		os.Exit(1)
+	}
+	// When the size and alignment of the bins are known up front, timestamps
+	// are binned as they're read. When only the size isn't, they're counted
+	// in narrow bins which are re-binned once the data has been seen, and
+	// when the alignment isn't, every distinct timestamp is kept until then.
+	adaptive := false
+	switch strings.ToLower(*unit) {
+	case "auto", "fd":
+		adaptive = true
+	}
+	exact := isRelativeOrigin(*binOrigin)
+	if *follow && (adaptive || exact || *clipPct > 0) {
+		fmt.Printf("--follow needs bins of a fixed size and alignment, so it cannot be used with '--unit %s', --clip-percentile, or a --bin-origin of start or end; try e.g. '--unit 1m'\n", *unit)
+		os.Exit(1)
+	}
+	precision := timestampPrecision(epochUnitDur)
+	var acc *tbin.Accumulator
+	var binner *tbin.Binner
+	if exact {
+		acc, err = tbin.NewExactAccumulator(precision)
+	} else if adaptive {
+		// The base bins are aligned like the bins they'll be re-binned into.
+		var opts tbin.BinOptions
+		opts, err = newBinOptions(nil, binLoc, precision)
+		if err == nil {
+			acc, err = tbin.NewAdaptiveAccumulator(tbin.DEFAULT_ACCUMULATOR_BINS, opts)
+		}
+	} else {
+		binner, err = newBinner(nil, binLoc, precision)
+		if err == nil {
+			acc = tbin.NewAccumulator(binner)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+	if *valueField != "" {
+		acc.TrackValues(needsQuantiles(aggs))
+	}
+	if *groupBy != "" {
+		acc.TrackGroups()
+	}
+	if intervals {
+		acc.TrackIntervals()
 	}
 
-	*unit = strings.ToLower(*unit)
-	if *unit == "auto" {
-		*unit, _ = tbin.EstimateBinSize(tss)
+	var forks []*timeformat.MultiParser
+	newParser := func() (*lineParser, error) {
+		x, err := newExtractor()
+		if err != nil {
+			return nil, err
+		}
+		v, err := newValueExtractor()
+		if err != nil {
+			return nil, err
+		}
+		g, err := newGroupExtractor()
+		if err != nil {
+			return nil, err
+		}
+		e, duration, err := newEndExtractor()
+		if err != nil {
+			return nil, err
+		}
+		p := &lineParser{
+			extractor:    x,
+			valuer:       v,
+			grouper:      g,
+			ender:        e,
+			duration:     duration,
+			durationUnit: durUnit,
+			parsefunc:    parsefunc,
+			epochfunc:    epochfunc,
+			precision:    precision,
+		}
+		if multiparser != nil {
+			fork := multiparser.Fork()
+			forks = append(forks, fork)
+			p.parsefunc = fork.Parse
+		}
+		return p, nil
+	}
+	if *follow {
+		live := newLiveChart(acc, binner, aggs, *unit, binLoc.String(), *sparse, *maxBins)
+		ctx, report, err := live.Context()
+		if err != nil {
+			fmt.Printf("cannot convert binned timestamp data into ChartJS data: %q", err.Error())
+			os.Exit(2)
+		}
+		go func() {
+			if err := live.Follow(files[0], newParser, policy); err != nil {
+				fmt.Printf("cannot read timestamps: %q\n", err.Error())
+				os.Exit(2)
+			}
+			fmt.Fprintf(os.Stderr, "Reached the end of %s, so no more timestamps will be added\n", files[0])
+		}()
+		go live.Run()
+		serveChart(ctx, report, live)
+		return
 	}
 
-	bins, err := tbin.BinTimestamps(tss, *unit)
+	report, err := read_lines_to_integers(files, newParser, policy, *workers, acc)
+	if multiparser != nil {
+		for _, fork := range forks {
+			multiparser.Merge(fork)
+		}
+		report.Layouts = multiparser.Counts()
+	}
+	fmt.Fprint(os.Stderr, report.String())
 	if err != nil {
-		fmt.Printf("cannot divide timestamps into bins: %q", err.Error())
+		fmt.Printf("cannot read timestamps: %q", err.Error())
+		os.Exit(2)
+	}
+	if acc.Count() == 0 {
+		fmt.Printf("no timestamps were found in the input, so there's nothing to graph\n")
 		os.Exit(2)
 	}
 
-	ctx, err := tbin.FormatBinDataForChartJS(bins)
+	if *clipPct > 0 {
+		dropped, lo, hi, err := acc.ClipPercentile(*clipPct)
+		if err != nil {
+			fmt.Printf("invalid --clip-percentile: %q\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "Clipped %d timestamps outside of %s to %s\n", dropped, fmtTimestamp(lo, precision), fmtTimestamp(hi, precision))
+	}
+	bins := acc.Bins()
+	// rebin is the binner which the base bins of an adaptive or exact
+	// accumulator are re-binned with.
+	var rebin *tbin.Binner
+	if binner == nil {
+		switch strings.ToLower(*unit) {
+		case "auto":
+			*unit, _ = acc.EstimateBinSize(*targetBins)
+			fmt.Fprintf(os.Stderr, "Using bins of size %s, aiming for about %d bins\n", *unit, *targetBins)
+		case "fd":
+			*unit, _ = acc.EstimateBinSizeFD()
+			fmt.Fprintf(os.Stderr, "Using bins of size %s, chosen by the Freedman-Diaconis rule\n", *unit)
+		}
+		binner, err = newBinner(acc, binLoc, precision)
+		if err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		bins = acc.Rebin(binner)
+		rebin = binner
+	}
+
+	series := newChartSeries(acc, rebin)
+	var ctx tbin.ChartJSCtx
+	if intervals {
+		// Long intervals keep every bin they span from being empty, so
+		// --max-bins applies even with --sparse.
+		if err := checkBinCount(binner, acc); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		ctx, err = formatIntervalChart(acc, binner)
+	} else if *sparse {
+		ctx, err = formatChart(bins, series, aggs, *unit, precision, binner.Gaps(bins))
+	} else {
+		if err := checkBinCount(binner, acc); err != nil {
+			fmt.Printf("%s\n", err.Error())
+			os.Exit(1)
+		}
+		binner.FillGaps(bins)
+		ctx, err = formatChart(bins, series, aggs, *unit, precision, nil)
+	}
 	if err != nil {
 		fmt.Printf("cannot convert binned timestamp data into ChartJS data: %q", err.Error())
 		os.Exit(2)
 	}
+	ctx.BinTZ = binLoc.String()
+	serveChart(ctx, report, nil)
+}
+
+// renderPage fills in the placeholders of IndexHTML. Every placeholder is
+// replaced in a single pass, so that text which is filled in, such as group
+// keys in the chart's context, is never itself taken for a placeholder.
+func renderPage(ctxjson, reportjson []byte, live bool, title string) string {
+	r := strings.NewReplacer(
+		"REPLACE_ME_WITH_JS_CONTEXT", string(ctxjson),
+		"REPLACE_ME_WITH_PARSE_REPORT", string(reportjson),
+		"REPLACE_ME_WITH_LIVE", fmt.Sprintf("%t", live),
+		"REPLACE_ME_WITH_BUNDLEJS", BundleJS,
+		"TITLE_HERE", html.EscapeString(title),
+	)
+	return r.Replace(IndexHTML)
+}
+
+// serveChart writes out the HTML file showing ctx and report, then serves it
+// until the program is killed. If live isn't nil then its events are served
+// too, for the page to update the chart as timestamps are read.
+func serveChart(ctx tbin.ChartJSCtx, report parseReport, live *liveChart) {
 	ctxjson, err := json.MarshalIndent(ctx, "", "    ")
 	if err != nil {
 		fmt.Printf("cannot marshal ChartJS data into JSON format: %q", err.Error())
 		os.Exit(2)
 	}
+	reportjson, err := json.MarshalIndent(report, "", "    ")
+	if err != nil {
+		fmt.Printf("cannot marshal parse report into JSON format: %q", err.Error())
+		os.Exit(2)
+	}
 
 	// Asterisk tell CreateTemp where to put a random filename component, which
 	// we want to avoid collisions.
@@ -148,12 +511,7 @@ func main() {
 	}
 	defer f.Close()
 
-	jslib := BundleJS
-	html_tmplfile := IndexHTML
-
-	html_tmplfile = strings.ReplaceAll(html_tmplfile, "REPLACE_ME_WITH_JS_CONTEXT", string(ctxjson))
-	html_tmplfile = strings.ReplaceAll(html_tmplfile, "REPLACE_ME_WITH_BUNDLEJS", jslib)
-	html_tmplfile = strings.ReplaceAll(html_tmplfile, "TITLE_HERE", *title)
+	html_tmplfile := renderPage(ctxjson, reportjson, live != nil, *title)
 
 	fmt.Fprintf(f, "%s\n", html_tmplfile)
 	fmt.Printf("Wrote new HTML view file to file %q at path %q\n", f.Name(), tmpdir)
@@ -171,6 +529,9 @@ func main() {
 			log.Printf("Serving file at %q\n", fullFP)
 			http.ServeFile(w, req, fullFP)
 		})
+		if live != nil {
+			mux.Handle("/events", live)
+		}
 	}
 
 	listener, err := net.Listen("tcp", ":0")
@@ -190,45 +551,6 @@ func main() {
 	}
 }
 
-// read_lines_to_integers attempts to parse each non-empty lines in r as a time
-// parsable by parsefunc. Each integer in the output represents a count of
-// milliseconds since UNIX epoch.
-//
-// If a line fails to parse, then an error is returned. Before returning though,
-// a hint is printed on stderr to the user indicating what that line's timestamp
-// format _should_ have been, via our best guess.
-func read_lines_to_integers(r io.Reader, parsefunc func(string) (time.Time, error)) ([]int64, error) {
-	tss := []int64{}
-	scnr := bufio.NewScanner(r)
-	var i int = 0
-	for scnr.Scan() {
-		i += 1
-		line := scnr.Text()
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		var ts int64
-		var err error
-		if parsefunc == nil {
-			ts, err = strconv.ParseInt(line, 10, 64)
-			if err != nil {
-				fmt.Fprint(os.Stderr, timeformat.GuessTimestampFormat(line))
-				return nil, fmt.Errorf("cannot parse integer on line %d of stdin: %w\n", i, err)
-			}
-		} else {
-			t, err := parsefunc(line)
-			if err != nil {
-				fmt.Fprint(os.Stderr, timeformat.GuessTimestampFormat(line))
-				return nil, fmt.Errorf("cannot parse line %d of stdin to date: %w", i, err)
-			}
-			ts = t.UnixMilli()
-		}
-		tss = append(tss, ts)
-	}
-	return tss, nil
-}
-
 func openbrowser(url string) {
 	var err error
 
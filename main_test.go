@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenderPage(t *testing.T) {
+	ctx := tbin.ChartJSCtx{Unit: "minute", BinSize: "1m", BinTZ: "UTC"}
+	// Group keys and failing lines come from the input, so they may look
+	// like placeholders.
+	for _, key := range []string{"TITLE_HERE", "REPLACE_ME_WITH_BUNDLEJS", "REPLACE_ME_WITH_LIVE", "REPLACE_ME_WITH_JS_CONTEXT"} {
+		ctx.Datasets = append(ctx.Datasets, tbin.ChartJSDataset{Label: "count", Series: key})
+	}
+	report := parseReport{Failures: []parseFailure{{Sample: "REPLACE_ME_WITH_PARSE_REPORT TITLE_HERE"}}}
+	ctxjson, err := json.Marshal(ctx)
+	require.NoError(t, err)
+	reportjson, err := json.Marshal(report)
+	require.NoError(t, err)
+
+	page := renderPage(ctxjson, reportjson, false, `a"b</title><script>`)
+	require.Contains(t, page, "<title>a&#34;b&lt;/title&gt;&lt;script&gt;</title>")
+
+	m := regexp.MustCompile(`(?s)const CONTEXT = (.*?);\n\s*const REPORT = (.*?);\n\s*const LIVE = (.*?);\n`).FindStringSubmatch(page)
+	require.NotNil(t, m)
+	var gotCtx tbin.ChartJSCtx
+	require.NoError(t, json.Unmarshal([]byte(m[1]), &gotCtx))
+	require.Equal(t, ctx, gotCtx)
+	var gotReport parseReport
+	require.NoError(t, json.Unmarshal([]byte(m[2]), &gotReport))
+	require.Equal(t, report, gotReport)
+	require.Equal(t, "false", m[3])
+}
+
+func TestCheckBinCount(t *testing.T) {
+	defer func(u string, m int64) { *unit, *maxBins = u, m }(*unit, *maxBins)
+	day := int64(24 * 60 * 60 * 1000)
+	year := 366 * day
+
+	type tcase struct {
+		Unit    string
+		MaxBins int64
+		First   int64
+		Last    int64
+		// ExpErr is a substring of the error, if there are too many bins.
+		ExpErr string
+	}
+	for idx, test := range []tcase{
+		{Unit: "1m", MaxBins: 2000, First: 0, Last: day},
+		{Unit: "1m", MaxBins: 0, First: 0, Last: 100 * day},
+		{Unit: "1m", MaxBins: 100, First: 0, Last: day, ExpErr: "try a larger --unit such as 15m,"},
+		{Unit: "1h30m", MaxBins: 10, First: 0, Last: day, ExpErr: "try a larger --unit such as 3h,"},
+		// There's no nice size larger than 100Y to suggest.
+		{Unit: "100Y", MaxBins: 10, First: -100000 * year, Last: 100000 * year, ExpErr: "; try --sparse to leave out empty bins"},
+		{Unit: "50Y", MaxBins: 10, First: -100000 * year, Last: 100000 * year, ExpErr: "; try --sparse to leave out empty bins"},
+	} {
+		*unit, *maxBins = test.Unit, test.MaxBins
+		b, err := tbin.NewBinner(test.Unit, tbin.BinOptions{})
+		require.NoError(t, err, "for test #%d", idx)
+		acc := tbin.NewAccumulator(b)
+		acc.Add(test.First)
+		acc.Add(test.Last)
+		err = checkBinCount(b, acc)
+		if test.ExpErr == "" {
+			require.NoError(t, err, "for test #%d", idx)
+			continue
+		}
+		require.Error(t, err, "for test #%d", idx)
+		require.Contains(t, err.Error(), test.ExpErr, "for test #%d", idx)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+)
+
+// The most lines and bytes of input in each chunk handed to a worker.
+const (
+	chunkMaxLines = 4096
+	chunkMaxBytes = 1 << 20
+)
+
+// chunk is a run of consecutive lines of input.
+type chunk struct {
+	// Input names the input which the lines are from.
+	Input string
+	Index int
+	// FirstLine is the 1-based line number of the first of Lines.
+	FirstLine int
+	Lines     []string
+}
+
+// chunkResult is what happened to each line of a chunk.
+type chunkResult struct {
+	Index int
+	// Report counts the lines of the chunk by what happened to them; its
+	// failures are left in Failures instead.
+	Report   parseReport
+	Failures []lineFailure
+}
+
+// lineFailure is a line which couldn't be turned into a timestamp.
+type lineFailure struct {
+	Input  string
+	Line   int
+	Sample string
+	// Err describes the failure including the line number, while Cause is
+	// just the reason that the line failed.
+	Err   error
+	Cause error
+	// Unparsed is set when a timestamp was found but couldn't be parsed, as
+	// opposed to not being extracted at all.
+	Unparsed bool
+	// Before counts the lines of the chunk preceding this one, so that the
+	// report is exact when reading stops at this line.
+	Before parseReport
+}
+
+// chunkReader splits input into chunks of lines. Lines may be of any length,
+// and may end with either "\n" or "\r\n", which isn't included in the line.
+type chunkReader struct {
+	rdr   *bufio.Reader
+	name  string
+	index int
+	line  int
+	err   error
+}
+
+// newChunkReader reads chunks of lines from r, which is the input named name.
+func newChunkReader(r io.Reader, name string) *chunkReader {
+	return &chunkReader{rdr: bufio.NewReader(r), name: name}
+}
+
+// Next returns the next chunk of input, or false once the input is
+// exhausted or cannot be read; Err says which.
+func (cr *chunkReader) Next() (chunk, bool) {
+	c := chunk{Input: cr.name, Index: cr.index, FirstLine: cr.line + 1}
+	size := 0
+	for cr.err == nil && len(c.Lines) < chunkMaxLines && size < chunkMaxBytes {
+		line, err := cr.rdr.ReadString('\n')
+		if err != nil && err != io.EOF {
+			// Whatever was read of the line is incomplete, so leave it out.
+			cr.err = fmt.Errorf("cannot read line %d of %s: %w", cr.line+len(c.Lines)+1, cr.name, err)
+			break
+		}
+		if err == io.EOF {
+			cr.err = io.EOF
+			if line == "" {
+				break
+			}
+		}
+		line = trimLineEnding(line)
+		c.Lines = append(c.Lines, line)
+		size += len(line)
+	}
+	if len(c.Lines) == 0 {
+		return c, false
+	}
+	cr.index += 1
+	cr.line += len(c.Lines)
+	return c, true
+}
+
+// trimLineEnding removes the "\n" or "\r\n" from the end of line.
+func trimLineEnding(line string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+}
+
+// Err returns the error which stopped cr from reading, if it wasn't reaching
+// the end of the input.
+func (cr *chunkReader) Err() error {
+	if cr.err == io.EOF {
+		return nil
+	}
+	return cr.err
+}
+
+// parseChunk turns each line of c into a timestamp with p, adding them to
+// acc.
+func parseChunk(c chunk, p *lineParser, acc *tbin.Accumulator) chunkResult {
+	res := chunkResult{Index: c.Index}
+	for j, line := range c.Lines {
+		i := c.FirstLine + j
+		pl, outcome, failure := p.parseLine(c.Input, i, line)
+		switch outcome {
+		case lineParsed:
+			pl.addTo(acc)
+		case lineFailed:
+			failure.Before = res.Report
+			res.Failures = append(res.Failures, failure)
+		}
+		res.Report.count(outcome)
+	}
+	return res
+}
+
+// firstNonBlank returns the first line of lines which isn't blank.
+func firstNonBlank(lines []string) (string, bool) {
+	for _, line := range lines {
+		if strings.TrimSpace(line) != "" {
+			return line, true
+		}
+	}
+	return "", false
+}
+
+// parseChunks parses every chunk of cr on workers goroutines, passing each
+// chunkResult to handle in order of the chunks. If handle returns false then
+// parsing stops early. Each worker gets its own lineParser from newParser and
+// its own fork of acc, which are merged back into acc once all chunks are
+// parsed. If the input cannot be read then the lines before the failure are
+// still parsed and handled, and then the read error is returned.
+//
+// The first chunk is parsed before any others so that extractors which learn
+// from the first line, such as the column names in a header, can be primed
+// with it before parsing the rest of the input.
+func parseChunks(cr *chunkReader, workers int, newParser func() (*lineParser, error), acc *tbin.Accumulator, handle func(chunkResult) bool) error {
+	if workers < 1 {
+		workers = 1
+	}
+	first, ok := cr.Next()
+	if !ok {
+		return cr.Err()
+	}
+	p, err := newParser()
+	if err != nil {
+		return err
+	}
+	if !handle(parseChunk(first, p, acc)) {
+		return nil
+	}
+	header, _ := firstNonBlank(first.Lines)
+
+	parsers := []*lineParser{}
+	accs := []*tbin.Accumulator{}
+	for w := 0; w < workers; w++ {
+		p, err := newParser()
+		if err != nil {
+			return err
+		}
+		p.prime(header)
+		parsers = append(parsers, p)
+		accs = append(accs, acc.Fork())
+	}
+
+	done := make(chan struct{})
+	jobs := make(chan chunk, workers*2)
+	results := make(chan chunkResult, workers*2)
+	go func() {
+		defer close(jobs)
+		for {
+			c, ok := cr.Next()
+			if !ok {
+				return
+			}
+			select {
+			case jobs <- c:
+			case <-done:
+				return
+			}
+		}
+	}()
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(p *lineParser, wacc *tbin.Accumulator) {
+			defer wg.Done()
+			for c := range jobs {
+				select {
+				case results <- parseChunk(c, p, wacc):
+				case <-done:
+					return
+				}
+			}
+		}(parsers[w], accs[w])
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Results arrive in whatever order the workers finish, so hold on to
+	// them until every earlier chunk has been handled.
+	pending := map[int]chunkResult{}
+	next := first.Index + 1
+	for res := range results {
+		pending[res.Index] = res
+		for {
+			res, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next += 1
+			if !handle(res) {
+				close(done)
+				return nil
+			}
+		}
+	}
+	for _, wacc := range accs {
+		acc.Merge(wacc)
+	}
+	// The reading goroutine is done with cr once every chunk is parsed.
+	return cr.Err()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/lelandbatey/histogram_timestamps/extract"
+	"github.com/lelandbatey/histogram_timestamps/tbin"
+	"github.com/lelandbatey/histogram_timestamps/timeformat"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testWorkers are the numbers of workers which inputs are read with, so that
+// the results can be checked to not depend on how many there are.
+var testWorkers = []int{1, 2, 3, 8}
+
+// writeInput writes lines to a new file in dir, returning its path.
+func writeInput(t *testing.T, dir, name string, lines []string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644))
+	return path
+}
+
+// epochLines returns n lines each holding a timestamp in epoch_ms format,
+// one second apart.
+func epochLines(n int) []string {
+	lines := []string{}
+	for i := 0; i < n; i++ {
+		lines = append(lines, fmt.Sprint(1700000000000+int64(i)*1000))
+	}
+	return lines
+}
+
+// newTestParser returns a func making lineParsers of epoch_ms timestamps,
+// which are found by x if it's given.
+func newTestParser(x func() (extract.Extractor, extract.Extractor, error)) func() (*lineParser, error) {
+	return func() (*lineParser, error) {
+		parse := timeformat.MakeParseEpoch(time.Millisecond)
+		p := &lineParser{parsefunc: parse, epochfunc: parse, precision: tbin.DEFAULT_PRECISION}
+		if x != nil {
+			var err error
+			p.extractor, p.valuer, err = x()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return p, nil
+	}
+}
+
+// newTestAccumulator returns an Accumulator of epoch_ms timestamps in one
+// minute bins.
+func newTestAccumulator(t *testing.T) *tbin.Accumulator {
+	b, err := tbin.NewBinner("1m", tbin.BinOptions{})
+	require.NoError(t, err)
+	return tbin.NewAccumulator(b)
+}
+
+func TestChunkReader(t *testing.T) {
+	long := `{"ts": "` + strings.Repeat("x", 100000) + `"}`
+	many := epochLines(chunkMaxLines + 3)
+	errDisk := errors.New("disk on fire")
+
+	type tcase struct {
+		Name  string
+		Input io.Reader
+		// ExpChunks are the lines of each chunk read.
+		ExpChunks [][]string
+		ExpErr    error
+	}
+	for _, test := range []tcase{
+		{
+			Name:      "long line",
+			Input:     strings.NewReader("1\n" + long + "\n2\n"),
+			ExpChunks: [][]string{{"1", long, "2"}},
+		},
+		{
+			Name:      "CRLF",
+			Input:     strings.NewReader("1\r\n\r\n2\r\n3"),
+			ExpChunks: [][]string{{"1", "", "2", "3"}},
+		},
+		{
+			Name:      "BOM",
+			Input:     strings.NewReader(utf8BOM + "1\n2\n"),
+			ExpChunks: [][]string{{"1", "2"}},
+		},
+		{
+			// Only a BOM at the very start is skipped.
+			Name:      "BOM later",
+			Input:     strings.NewReader("1\n" + utf8BOM + "2\n"),
+			ExpChunks: [][]string{{"1", utf8BOM + "2"}},
+		},
+		{
+			Name:      "no trailing newline",
+			Input:     strings.NewReader("1\n2"),
+			ExpChunks: [][]string{{"1", "2"}},
+		},
+		{
+			Name:      "empty",
+			Input:     strings.NewReader(""),
+			ExpChunks: [][]string{},
+		},
+		{
+			Name:      "several chunks",
+			Input:     strings.NewReader(strings.Join(many, "\n")),
+			ExpChunks: [][]string{many[:chunkMaxLines], many[chunkMaxLines:]},
+		},
+		{
+			// The partly read line is left out.
+			Name:      "read error",
+			Input:     io.MultiReader(strings.NewReader(utf8BOM+"1\r\n2\n3"), iotest.ErrReader(errDisk)),
+			ExpChunks: [][]string{{"1", "2"}},
+			ExpErr:    fmt.Errorf("cannot read line 3 of input: %w", errDisk),
+		},
+		{
+			Name:      "read error in a long line",
+			Input:     io.MultiReader(strings.NewReader("1\n"+long), iotest.ErrReader(errDisk)),
+			ExpChunks: [][]string{{"1"}},
+			ExpErr:    fmt.Errorf("cannot read line 2 of input: %w", errDisk),
+		},
+		{
+			Name:      "read error at once",
+			Input:     iotest.ErrReader(errDisk),
+			ExpChunks: [][]string{},
+			ExpErr:    fmt.Errorf("cannot read line 1 of input: %w", errDisk),
+		},
+	} {
+		t.Run(test.Name, func(t *testing.T) {
+			cr := newChunkReader(skipBOM(test.Input), "input")
+			chunks := [][]string{}
+			line := 1
+			for {
+				c, ok := cr.Next()
+				if !ok {
+					break
+				}
+				require.Equal(t, "input", c.Input)
+				require.Equal(t, len(chunks), c.Index)
+				require.Equal(t, line, c.FirstLine)
+				chunks = append(chunks, c.Lines)
+				line += len(c.Lines)
+			}
+			require.Equal(t, test.ExpChunks, chunks)
+			require.Equal(t, test.ExpErr, cr.Err())
+			if test.ExpErr != nil {
+				require.True(t, errors.Is(cr.Err(), errDisk))
+			}
+		})
+	}
+}
+
+func TestReadLinesToIntegers(t *testing.T) {
+	// Enough lines for several chunks, so that they're spread across the
+	// workers.
+	n := 3*chunkMaxLines + 100
+	withBad := func(bad ...int) []string {
+		lines := epochLines(n)
+		for _, i := range bad {
+			lines[i-1] = fmt.Sprintf("not a timestamp %d", i)
+		}
+		return lines
+	}
+
+	type tcase struct {
+		Name   string
+		Lines  []string
+		Policy errorPolicy
+		// ExpErr is a substring of the error, if reading fails.
+		ExpErr    string
+		ExpReport parseReport
+		// ExpFailed are the line numbers of the failures reported.
+		ExpFailed []int
+	}
+	for _, test := range []tcase{
+		{
+			Name:      "all parsed",
+			Lines:     epochLines(n),
+			Policy:    errorPolicy{Mode: onErrorFail},
+			ExpReport: parseReport{LinesRead: n, Parsed: n},
+		},
+		{
+			// Reading stops partway through a chunk which isn't the first,
+			// and only the lines up to the failure are counted.
+			Name:      "fail in a later chunk",
+			Lines:     withBad(2*chunkMaxLines + 17),
+			Policy:    errorPolicy{Mode: onErrorFail},
+			ExpErr:    fmt.Sprintf("cannot parse line %d of ", 2*chunkMaxLines+17),
+			ExpReport: parseReport{LinesRead: 2*chunkMaxLines + 17, Parsed: 2*chunkMaxLines + 16, Failed: 1},
+			ExpFailed: []int{2*chunkMaxLines + 17},
+		},
+		{
+			// The earliest failure is reported, even when a worker gets to a
+			// later one first.
+			Name:      "fail at the earliest of several",
+			Lines:     withBad(chunkMaxLines+5, 3*chunkMaxLines+1, 2*chunkMaxLines),
+			Policy:    errorPolicy{Mode: onErrorFail},
+			ExpErr:    fmt.Sprintf("cannot parse line %d of ", chunkMaxLines+5),
+			ExpReport: parseReport{LinesRead: chunkMaxLines + 5, Parsed: chunkMaxLines + 4, Failed: 1},
+			ExpFailed: []int{chunkMaxLines + 5},
+		},
+		{
+			Name:      "fail in the first chunk",
+			Lines:     withBad(3),
+			Policy:    errorPolicy{Mode: onErrorFail},
+			ExpErr:    "cannot parse line 3 of ",
+			ExpReport: parseReport{LinesRead: 3, Parsed: 2, Failed: 1},
+			ExpFailed: []int{3},
+		},
+		{
+			Name:      "skip in order",
+			Lines:     withBad(3*chunkMaxLines+1, 7, chunkMaxLines, chunkMaxLines+1),
+			Policy:    errorPolicy{Mode: onErrorSkip},
+			ExpReport: parseReport{LinesRead: n, Parsed: n - 4, Failed: 4},
+			ExpFailed: []int{7, chunkMaxLines, chunkMaxLines + 1, 3*chunkMaxLines + 1},
+		},
+		{
+			// Giving up after too many failures stops at the failure which
+			// is one too many.
+			Name:      "skip until too many",
+			Lines:     withBad(10, chunkMaxLines+10, 2*chunkMaxLines+10, 3*chunkMaxLines+10),
+			Policy:    errorPolicy{Mode: onErrorSkip, MaxErrors: 2},
+			ExpErr:    "giving up after more than 2 lines failed to parse",
+			ExpReport: parseReport{LinesRead: 2*chunkMaxLines + 10, Parsed: 2*chunkMaxLines + 7, Failed: 3},
+			ExpFailed: []int{10, chunkMaxLines + 10, 2*chunkMaxLines + 10},
+		},
+		{
+			Name:      "blank lines",
+			Lines:     append([]string{"", "  "}, epochLines(chunkMaxLines+1)...),
+			Policy:    errorPolicy{Mode: onErrorFail},
+			ExpReport: parseReport{LinesRead: chunkMaxLines + 3, Parsed: chunkMaxLines + 1, Blank: 2},
+		},
+	} {
+		for _, workers := range testWorkers {
+			t.Run(fmt.Sprintf("%s with %d workers", test.Name, workers), func(t *testing.T) {
+				path := writeInput(t, t.TempDir(), "input.txt", test.Lines)
+				acc := newTestAccumulator(t)
+				report, err := read_lines_to_integers(newInputFiles([]string{path}), newTestParser(nil), test.Policy, workers, acc)
+				if test.ExpErr == "" {
+					require.NoError(t, err)
+					require.Equal(t, int64(report.Parsed), acc.Count())
+				} else {
+					require.Error(t, err)
+					require.Contains(t, err.Error(), test.ExpErr)
+				}
+				var failed []int
+				for _, f := range report.Failures {
+					failed = append(failed, f.Line)
+				}
+				require.Equal(t, test.ExpFailed, failed)
+				report.Failures = nil
+				require.Equal(t, test.ExpReport, report)
+			})
+		}
+	}
+}
+
+func TestReadLinesToIntegersHeader(t *testing.T) {
+	// The header is only in the first chunk, so the extractors of the
+	// workers parsing the rest must be primed with it to find the columns.
+	lines := []string{"", "value,ts"}
+	for i, line := range epochLines(3 * chunkMaxLines) {
+		lines = append(lines, fmt.Sprintf("%d,%s", i%5, line))
+	}
+	var expSum float64
+	for i := 0; i < 3*chunkMaxLines; i++ {
+		expSum += float64(i % 5)
+	}
+	newParser := newTestParser(func() (extract.Extractor, extract.Extractor, error) {
+		x, err := extract.NewDelimitedExtractor(',', "ts", true)
+		if err != nil {
+			return nil, nil, err
+		}
+		v, err := extract.NewDelimitedExtractor(',', "value", true)
+		return x, v, err
+	})
+
+	for _, workers := range testWorkers {
+		dir := t.TempDir()
+		// Each file starts with its own header.
+		files := newInputFiles([]string{
+			writeInput(t, dir, "a.csv", lines),
+			writeInput(t, dir, "b.csv", lines),
+		})
+		acc := newTestAccumulator(t)
+		acc.TrackValues(false)
+		report, err := read_lines_to_integers(files, newParser, errorPolicy{Mode: onErrorFail}, workers, acc)
+		require.NoError(t, err, "with %d workers", workers)
+		require.Equal(t, parseReport{LinesRead: 2 * len(lines), Parsed: 6 * chunkMaxLines, Blank: 2, Headers: 2}, report, "with %d workers", workers)
+		require.Equal(t, int64(6*chunkMaxLines), acc.Count())
+		var sum float64
+		for _, v := range acc.Values() {
+			sum += v.Sum
+		}
+		require.Equal(t, 2*expSum, sum, "with %d workers", workers)
+	}
+}
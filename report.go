@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lelandbatey/histogram_timestamps/timeformat"
+)
+
+// maxReportedFailures is how many failing lines are kept as examples in a
+// parseReport.
+const maxReportedFailures = 5
+
+// Values for the --on-error flag.
+const (
+	onErrorFail = "fail"
+	onErrorSkip = "skip"
+	onErrorWarn = "warn"
+)
+
+// errorPolicy says what to do about lines whose timestamps cannot be
+// extracted or parsed.
+type errorPolicy struct {
+	// Mode is one of onErrorFail, onErrorSkip, or onErrorWarn.
+	Mode string
+	// MaxErrors is the number of failing lines tolerated in skip and warn
+	// modes before giving up; zero means there is no limit.
+	MaxErrors int
+}
+
+func newErrorPolicy(mode string, maxErrors int) (errorPolicy, error) {
+	mode = strings.ToLower(mode)
+	switch mode {
+	case onErrorFail, onErrorSkip, onErrorWarn:
+	default:
+		return errorPolicy{}, fmt.Errorf("unknown --on-error value %q, must be one of %s, %s, or %s", mode, onErrorFail, onErrorSkip, onErrorWarn)
+	}
+	if maxErrors < 0 {
+		return errorPolicy{}, fmt.Errorf("--max-errors must not be negative")
+	}
+	return errorPolicy{Mode: mode, MaxErrors: maxErrors}, nil
+}
+
+// parseFailure is an example of a line which could not be turned into a
+// timestamp.
+type parseFailure struct {
+	Input  string `json:"input"`
+	Line   int    `json:"line"`
+	Sample string `json:"sample"`
+	Error  string `json:"error"`
+}
+
+// parseReport records what happened to each line of input, so that users
+// can tell how much of their data made it into the histogram.
+type parseReport struct {
+	LinesRead int `json:"lines_read"`
+	Parsed    int `json:"parsed"`
+	Blank     int `json:"blank"`
+	Headers   int `json:"headers"`
+	// Unmatched counts lines in which the extractor found no timestamp.
+	Unmatched int `json:"unmatched"`
+	// Failed counts lines which could not be extracted from or parsed.
+	Failed   int            `json:"failed"`
+	Failures []parseFailure `json:"failures"`
+	// Layouts counts the timestamps parsed by each layout, when more than one
+	// layout was provided.
+	Layouts []timeformat.LayoutCount `json:"layouts,omitempty"`
+}
+
+// Skipped is the number of non-blank lines which didn't produce a
+// timestamp.
+func (r parseReport) Skipped() int {
+	return r.Unmatched + r.Failed
+}
+
+// count adds a line with the given outcome to r. Failed lines are counted
+// by addFailure instead, along with why they failed.
+func (r *parseReport) count(outcome lineOutcome) {
+	r.LinesRead += 1
+	switch outcome {
+	case lineParsed:
+		r.Parsed += 1
+	case lineBlank:
+		r.Blank += 1
+	case lineHeader:
+		r.Headers += 1
+	case lineUnmatched:
+		r.Unmatched += 1
+	}
+}
+
+func (r *parseReport) addFailure(input string, line int, sample string, err error) {
+	r.Failed += 1
+	if len(r.Failures) < maxReportedFailures {
+		r.Failures = append(r.Failures, parseFailure{Input: input, Line: line, Sample: smax(sample, 200), Error: err.Error()})
+	}
+}
+
+func (r parseReport) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Parse report: read %d lines; %d parsed, %d blank, %d skipped", r.LinesRead, r.Parsed, r.Blank, r.Skipped())
+	if r.Skipped() > 0 {
+		fmt.Fprintf(b, " (%d without a timestamp, %d failed to parse)", r.Unmatched, r.Failed)
+	}
+	b.WriteString("\n")
+	for _, f := range r.Failures {
+		fmt.Fprintf(b, "    line %d of %s: %q: %s\n", f.Line, f.Input, f.Sample, f.Error)
+	}
+	if r.Failed > len(r.Failures) {
+		fmt.Fprintf(b, "    ... and %d more failed lines\n", r.Failed-len(r.Failures))
+	}
+	if len(r.Layouts) > 0 {
+		b.WriteString("Lines matched by each layout:\n")
+		for _, lc := range r.Layouts {
+			fmt.Fprintf(b, "    %8d  %s\n", lc.Matched, lc.Layout)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,638 @@
+package tbin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ACCUMULATOR_WIDTHS are the widths of the base bins of an adaptive
+// Accumulator, from narrowest to widest, in nanoseconds; those narrower than
+// the precision of the timestamps are skipped. Each divides the next, so that
+// merging bins into the next width is exact, and each divides a day and the
+// sizes in NICE_BIN_SIZES that are much wider than itself, so that base bins
+// can be re-binned without straddling the boundaries of the final bins.
+var ACCUMULATOR_WIDTHS []int64 = []int64{
+	TD_1_ns, 10 * TD_1_ns, 100 * TD_1_ns,
+	TD_1_us_ns, 10 * TD_1_us_ns, 100 * TD_1_us_ns,
+	TD_1_ms_ns, 10 * TD_1_ms_ns, 100 * TD_1_ms_ns,
+	TD_1_sec_ns, 5 * TD_1_sec_ns, 15 * TD_1_sec_ns,
+	TD_1_min_ns, 5 * TD_1_min_ns, 15 * TD_1_min_ns,
+	TD_1_hr_ns, 3 * TD_1_hr_ns, TD_1_day_ns,
+}
+
+// DEFAULT_ACCUMULATOR_BINS is the number of base bins an adaptive Accumulator
+// holds before merging them into wider bins.
+const DEFAULT_ACCUMULATOR_BINS = 1 << 16
+
+// Accumulator counts timestamps into bins one at a time as they are read, so
+// that the memory it uses depends on the number of bins rather than the
+// number of timestamps.
+//
+// An Accumulator either bins timestamps with a Binner, when the size of the
+// bins is known up front, or is adaptive. An adaptive Accumulator counts
+// timestamps in narrow base bins, and whenever there are too many base bins
+// they're merged into wider ones. Once every timestamp has been added, the
+// base bins are re-binned into bins of the size chosen from the data. Base
+// bins are aligned in the same time zone and with the same offset as the
+// final bins, and are much narrower than those, so every base bin falls
+// wholly within one final bin and the result is the same as binning the
+// timestamps directly.
+type Accumulator struct {
+	binner    *Binner
+	precision int64
+	// bases bin timestamps into the base bins of each width of an adaptive
+	// Accumulator, from narrowest to widest, and widthIdx is the index of
+	// the Binner of the current base bins.
+	bases    []*Binner
+	widthIdx int
+	maxBins  int
+	hist     map[int64]int64
+	count    int64
+	min      int64
+	max      int64
+	// changed holds the bins whose counts changed since the last call to
+	// Changes, once TrackChanges has been called.
+	changed map[int64]bool
+	// values holds the statistics of the values of the timestamps in each
+	// bin, once TrackValues has been called.
+	values map[int64]*BinValues
+	// quantiles is set when values can compute quantiles.
+	quantiles bool
+	// groups holds an Accumulator of the timestamps given to AddGrouped with
+	// each key, once TrackGroups has been called.
+	groups map[string]*Accumulator
+	// other holds the timestamps whose keys came along once there were
+	// already MAX_GROUP_KEYS groups.
+	other *Accumulator
+	// intervals is set once TrackIntervals has been called, after which the
+	// start and end of each interval given to AddInterval are kept.
+	intervals bool
+	starts    []int64
+	ends      []int64
+}
+
+// MAX_GROUP_KEYS is the most distinct keys an Accumulator keeps a group for,
+// so that grouping by a key with very many values, such as a user ID, can't
+// use unbounded memory. Timestamps with any further keys are only counted
+// together, as part of the group of others returned by TopGroups.
+const MAX_GROUP_KEYS = 10000
+
+// NewAccumulator creates an Accumulator which counts timestamps into the
+// bins of b.
+func NewAccumulator(b *Binner) *Accumulator {
+	return &Accumulator{binner: b, precision: b.precision, hist: map[int64]int64{}}
+}
+
+// NewExactAccumulator creates an adaptive Accumulator whose base bins are a
+// single unit of precision wide and are never widened, so that it keeps every
+// distinct timestamp. That's needed when the bins can't be aligned until every
+// timestamp has been seen, such as bins starting at the earliest timestamp,
+// but the memory it uses grows with the number of distinct timestamps. If
+// precision is zero, it's DEFAULT_PRECISION.
+func NewExactAccumulator(precision int64) (*Accumulator, error) {
+	precision, err := checkPrecision(precision)
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBinnerOfWidth(precision, BinOptions{Precision: precision})
+	if err != nil {
+		return nil, err
+	}
+	return &Accumulator{precision: precision, bases: []*Binner{b}, hist: map[int64]int64{}}, nil
+}
+
+// NewAdaptiveAccumulator creates an adaptive Accumulator which holds about
+// maxBins base bins, for re-binning into bins aligned per opts. The base
+// bins are aligned in opts.Location and moved by opts.Offset. If opts has an
+// Origin, base bins are only widened while their boundaries fall on it, so
+// the Accumulator may hold more than maxBins of them.
+func NewAdaptiveAccumulator(maxBins int, opts BinOptions) (*Accumulator, error) {
+	if maxBins < 1 {
+		maxBins = DEFAULT_ACCUMULATOR_BINS
+	}
+	precision, err := checkPrecision(opts.Precision)
+	if err != nil {
+		return nil, err
+	}
+	a := &Accumulator{precision: precision, maxBins: maxBins, hist: map[int64]int64{}}
+	baseOpts := BinOptions{Location: opts.Location, Offset: opts.Offset, Precision: precision}
+	for _, width := range ACCUMULATOR_WIDTHS {
+		if width%precision != 0 {
+			continue
+		}
+		b, err := newBinnerOfWidth(width, baseOpts)
+		if err != nil {
+			return nil, err
+		}
+		// Wider base bins wouldn't have a boundary at the origin either,
+		// since each width divides the next.
+		if opts.Origin != nil && b.sinceBinStart(addClamped(b.wall(*opts.Origin), opts.Offset)) != 0 {
+			break
+		}
+		a.bases = append(a.bases, b)
+	}
+	if len(a.bases) == 0 {
+		// Base bins a single unit of precision wide are always aligned.
+		return NewExactAccumulator(precision)
+	}
+	return a, nil
+}
+
+// Add counts ts.
+func (a *Accumulator) Add(ts int64) {
+	a.AddValue(ts, 1)
+}
+
+// AddGrouped counts ts as AddValue does, also counting it in the group of
+// key if TrackGroups has been called.
+func (a *Accumulator) AddGrouped(key string, ts int64, value float64) {
+	a.AddValue(ts, value)
+	if a.groups != nil {
+		a.group(key).AddValue(ts, value)
+	}
+}
+
+// AddInterval counts the start of the interval from start to end, keeping
+// the interval for BinIntervals if TrackIntervals has been called. The end
+// counts towards the latest timestamp added, but not towards any bin.
+func (a *Accumulator) AddInterval(start, end int64) {
+	a.AddValue(start, 1)
+	if a.intervals {
+		a.starts = append(a.starts, start)
+		a.ends = append(a.ends, end)
+	}
+	if end > a.max {
+		a.max = end
+	}
+}
+
+// AddValue counts ts, adding value to the values of its bin if TrackValues
+// has been called.
+func (a *Accumulator) AddValue(ts int64, value float64) {
+	if a.count == 0 || ts < a.min {
+		a.min = ts
+	}
+	if a.count == 0 || ts > a.max {
+		a.max = ts
+	}
+	a.count += 1
+	k := a.bin(ts)
+	a.hist[k] += 1
+	if a.values != nil {
+		a.valuesOf(k).Add(value)
+	}
+	if a.changed != nil {
+		a.changed[k] = true
+	}
+	if a.binner == nil && len(a.hist) > a.maxBins && a.widthIdx < len(a.bases)-1 {
+		a.widen()
+	}
+}
+
+func (a *Accumulator) bin(ts int64) int64 {
+	return a.binnerOf().Bin(ts)
+}
+
+// granularity returns the width in nanoseconds which the sizes of bins that
+// a is re-binned into must be a multiple of: that of the current base bins of
+// an adaptive Accumulator, or else the precision of its timestamps.
+func (a *Accumulator) granularity() int64 {
+	if a.binner != nil {
+		return a.precision
+	}
+	return a.bases[a.widthIdx].spec.Width
+}
+
+// binnerOf returns the Binner of the bins of a, which for an adaptive
+// Accumulator are the current base bins.
+func (a *Accumulator) binnerOf() *Binner {
+	if a.binner != nil {
+		return a.binner
+	}
+	return a.bases[a.widthIdx]
+}
+
+// merge re-keys hist by the current width of the base bins.
+func (a *Accumulator) merge(hist map[int64]int64) map[int64]int64 {
+	merged := map[int64]int64{}
+	for k, v := range hist {
+		merged[a.bin(k)] += v
+	}
+	return merged
+}
+
+// mergeValues re-keys values by the current width of the base bins.
+func (a *Accumulator) mergeValues(values map[int64]*BinValues) map[int64]*BinValues {
+	if values == nil {
+		return nil
+	}
+	merged := map[int64]*BinValues{}
+	for k, v := range values {
+		mergeBinValues(merged, a.bin(k), v, a.quantiles)
+	}
+	return merged
+}
+
+// mergeBinValues adds v to the values of bin k of values.
+func mergeBinValues(values map[int64]*BinValues, k int64, v *BinValues, quantiles bool) {
+	into, ok := values[k]
+	if !ok {
+		into = NewBinValues(quantiles)
+		values[k] = into
+	}
+	into.Merge(v)
+}
+
+// valuesOf returns the values of bin k, adding them if need be.
+func (a *Accumulator) valuesOf(k int64) *BinValues {
+	v, ok := a.values[k]
+	if !ok {
+		v = NewBinValues(a.quantiles)
+		a.values[k] = v
+	}
+	return v
+}
+
+// widen merges the base bins of an adaptive Accumulator into bins of the
+// next width.
+func (a *Accumulator) widen() {
+	a.widthIdx += 1
+	a.hist = a.merge(a.hist)
+	a.values = a.mergeValues(a.values)
+}
+
+// Fork returns a new, empty Accumulator which bins timestamps the same way as
+// a, for counting timestamps on another goroutine. An Accumulator is not safe
+// for concurrent use, so each goroutine needs its own fork, which can then be
+// combined with Merge.
+func (a *Accumulator) Fork() *Accumulator {
+	fork := a.fork()
+	if a.groups != nil {
+		fork.TrackGroups()
+	}
+	return fork
+}
+
+// fork returns a new, empty Accumulator which bins timestamps and keeps their
+// values the same way as a, but doesn't group them.
+func (a *Accumulator) fork() *Accumulator {
+	fork := &Accumulator{binner: a.binner, precision: a.precision, bases: a.bases, widthIdx: a.widthIdx, maxBins: a.maxBins, hist: map[int64]int64{}}
+	if a.values != nil {
+		fork.TrackValues(a.quantiles)
+	}
+	fork.intervals = a.intervals
+	return fork
+}
+
+// Merge adds the timestamps counted by other, which must be a fork of a or
+// of the same Binner, to a.
+func (a *Accumulator) Merge(other *Accumulator) {
+	if other.count == 0 {
+		return
+	}
+	if a.count == 0 || other.min < a.min {
+		a.min = other.min
+	}
+	if a.count == 0 || other.max > a.max {
+		a.max = other.max
+	}
+	a.count += other.count
+	if other.widthIdx > a.widthIdx {
+		a.widthIdx = other.widthIdx
+		a.hist = a.merge(a.hist)
+		a.values = a.mergeValues(a.values)
+	}
+	for k, v := range other.hist {
+		a.hist[a.bin(k)] += v
+	}
+	if a.values != nil {
+		for k, v := range other.values {
+			a.valuesOf(a.bin(k)).Merge(v)
+		}
+	}
+	for a.binner == nil && len(a.hist) > a.maxBins && a.widthIdx < len(a.bases)-1 {
+		a.widen()
+	}
+	if a.intervals {
+		a.starts = append(a.starts, other.starts...)
+		a.ends = append(a.ends, other.ends...)
+	}
+	if a.groups != nil {
+		for key, g := range other.groups {
+			a.group(key).Merge(g)
+		}
+		if other.other != nil {
+			a.otherGroup().Merge(other.other)
+		}
+	}
+}
+
+// Precision returns the length in nanoseconds of the unit of the timestamps
+// that a counts.
+func (a *Accumulator) Precision() int64 {
+	return a.precision
+}
+
+// Count returns the number of timestamps added.
+func (a *Accumulator) Count() int64 {
+	return a.count
+}
+
+// Min returns the earliest timestamp added, or zero if none were.
+func (a *Accumulator) Min() int64 {
+	return a.min
+}
+
+// Max returns the latest timestamp added, or zero if none were.
+func (a *Accumulator) Max() int64 {
+	return a.max
+}
+
+// Bins returns the count of timestamps in each bin which any fell into. For
+// an adaptive Accumulator these are the base bins.
+func (a *Accumulator) Bins() map[int64]int64 {
+	return a.hist
+}
+
+// TrackValues makes a keep the statistics of the values given to AddValue
+// in each bin, for reporting by Values. Quantiles of the values can only be
+// computed if quantiles is set, since that takes more memory. It must be
+// called before any timestamps are added.
+func (a *Accumulator) TrackValues(quantiles bool) {
+	if a.values == nil {
+		a.values = map[int64]*BinValues{}
+		a.quantiles = quantiles
+	}
+}
+
+// TrackIntervals makes a keep the intervals given to AddInterval, for
+// binning by BinIntervals. It must be called before any intervals are added.
+func (a *Accumulator) TrackIntervals() {
+	a.intervals = true
+}
+
+// BinIntervals bins the intervals added to a with b, as
+// Binner.BinIntervals does, or returns an error unless TrackIntervals was
+// called.
+func (a *Accumulator) BinIntervals(b *Binner) (IntervalBins, error) {
+	if !a.intervals {
+		return IntervalBins{}, fmt.Errorf("intervals were not kept")
+	}
+	return b.BinIntervals(a.starts, a.ends)
+}
+
+// TrackGroups makes a count the timestamps given to AddGrouped with each key
+// separately as well, for reporting by TopGroups. It must be called before
+// any timestamps are added.
+func (a *Accumulator) TrackGroups() {
+	if a.groups == nil {
+		a.groups = map[string]*Accumulator{}
+	}
+}
+
+// group returns the Accumulator of the timestamps with key, adding it if
+// need be.
+func (a *Accumulator) group(key string) *Accumulator {
+	g, ok := a.groups[key]
+	if ok {
+		return g
+	}
+	if len(a.groups) >= MAX_GROUP_KEYS {
+		return a.otherGroup()
+	}
+	g = a.fork()
+	a.groups[key] = g
+	return g
+}
+
+// otherGroup returns the Accumulator of the timestamps whose keys came along
+// after MAX_GROUP_KEYS others, adding it if need be.
+func (a *Accumulator) otherGroup() *Accumulator {
+	if a.other == nil {
+		a.other = a.fork()
+	}
+	return a.other
+}
+
+// Group is the timestamps which were given to AddGrouped with the same key.
+type Group struct {
+	Key string
+	// Other is set on the group of the timestamps whose keys aren't among
+	// the other groups, which has no Key.
+	Other bool
+	Acc   *Accumulator
+}
+
+// TopGroups returns the n groups of a with the most timestamps, largest first,
+// followed by a group of the timestamps of every other key, if there are any.
+// If n is zero, every group is returned. It returns nil unless TrackGroups
+// was called.
+func (a *Accumulator) TopGroups(n int) []Group {
+	if a.groups == nil {
+		return nil
+	}
+	keys := []string{}
+	for key := range a.groups {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ci, cj := a.groups[keys[i]].count, a.groups[keys[j]].count
+		if ci != cj {
+			return ci > cj
+		}
+		return keys[i] < keys[j]
+	})
+	groups := []Group{}
+	var other *Accumulator
+	if a.other != nil {
+		other = a.fork()
+		other.Merge(a.other)
+	}
+	for i, key := range keys {
+		if n > 0 && i >= n {
+			if other == nil {
+				other = a.fork()
+			}
+			other.Merge(a.groups[key])
+			continue
+		}
+		groups = append(groups, Group{Key: key, Acc: a.groups[key]})
+	}
+	if other != nil && other.count > 0 {
+		groups = append(groups, Group{Other: true, Acc: other})
+	}
+	return groups
+}
+
+// Values returns the statistics of the values of the timestamps in each bin
+// which any fell into, or nil unless TrackValues was called. The bins are
+// those of Bins.
+func (a *Accumulator) Values() map[int64]*BinValues {
+	return a.values
+}
+
+// TrackChanges makes a keep track of which bins change as timestamps are
+// added, for reporting by Changes. This only makes sense for an Accumulator
+// with a Binner, since an adaptive one re-keys all its bins as it merges them.
+func (a *Accumulator) TrackChanges() {
+	if a.changed == nil {
+		a.changed = map[int64]bool{}
+	}
+}
+
+// Changes returns the count of timestamps in each bin which timestamps were
+// added to since the last call to Changes, or since TrackChanges was called.
+func (a *Accumulator) Changes() map[int64]int64 {
+	changes := map[int64]int64{}
+	for k := range a.changed {
+		changes[k] = a.hist[k]
+	}
+	if a.changed != nil {
+		a.changed = map[int64]bool{}
+	}
+	return changes
+}
+
+// Rebin returns the count of timestamps in each bin of b which any fell into,
+// like b.BinTimestampsSparse. Each bin of a is counted wholly in the bin of b
+// which its start falls into, so the bins of b should be no finer than those
+// of a; EstimateBinSize only picks sizes for which that holds.
+func (a *Accumulator) Rebin(b *Binner) map[int64]int64 {
+	hist := map[int64]int64{}
+	for k, v := range a.hist {
+		hist[b.Bin(k)] += v
+	}
+	return hist
+}
+
+// RebinValues returns the statistics of the values of the timestamps in each
+// bin of b which any fell into, as Rebin does for their counts, or nil unless
+// TrackValues was called.
+func (a *Accumulator) RebinValues(b *Binner) map[int64]*BinValues {
+	if a.values == nil {
+		return nil
+	}
+	values := map[int64]*BinValues{}
+	for k, v := range a.values {
+		mergeBinValues(values, b.Bin(k), v, a.quantiles)
+	}
+	return values
+}
+
+// keys returns the bins of a in order.
+func (a *Accumulator) keys() []int64 {
+	keys := []int64{}
+	for k := range a.hist {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// Quantile estimates the q'th quantile of the timestamps added, returning the
+// start of the bin which holds it.
+func (a *Accumulator) Quantile(q float64) int64 {
+	return a.binAtRank(int64(q * float64(a.count-1)))
+}
+
+// binAtRank returns the start of the bin holding the rank'th timestamp, in
+// order from the earliest.
+func (a *Accumulator) binAtRank(rank int64) int64 {
+	keys := a.keys()
+	if len(keys) == 0 {
+		return 0
+	}
+	var seen int64
+	for _, k := range keys {
+		seen += a.hist[k]
+		if seen > rank {
+			return k
+		}
+	}
+	return keys[len(keys)-1]
+}
+
+// ClipPercentile removes outliers from a, like the ClipPercentile function,
+// but at the resolution of the bins of a: whole bins below the one holding
+// the pct'th percentile, and above the one holding the (100-pct)'th, are
+// dropped. It returns the number of timestamps dropped and the range of the
+// bins that remain.
+func (a *Accumulator) ClipPercentile(pct float64) (int64, int64, int64, error) {
+	if pct < 0 || pct >= 50 {
+		return 0, 0, 0, fmt.Errorf("percentile to clip %v must be at least 0 and less than 50", pct)
+	}
+	if a.count == 0 {
+		return 0, 0, 0, nil
+	}
+	// Clip the same number of timestamps from each end, as ClipPercentile
+	// does.
+	rank := int64(pct / 100 * float64(a.count-1))
+	lo := a.binAtRank(rank)
+	hi := a.lastInBin(a.binAtRank(a.count - 1 - rank))
+	dropped := a.clip(lo, hi)
+	for _, g := range a.groups {
+		g.clip(lo, hi)
+	}
+	if a.other != nil {
+		a.other.clip(lo, hi)
+	}
+	// The intervals left may end after hi, but the timestamps kept don't.
+	last := a.max
+	if last > hi {
+		last = hi
+	}
+	return dropped, lo, last, nil
+}
+
+// clip removes the bins of a which start before lo or after hi, returning the
+// number of timestamps dropped.
+func (a *Accumulator) clip(lo, hi int64) int64 {
+	var dropped int64
+	for k, v := range a.hist {
+		if k < lo || k > hi {
+			dropped += v
+			delete(a.hist, k)
+			delete(a.values, k)
+		}
+	}
+	a.count -= dropped
+	if a.min < lo {
+		a.min = lo
+	}
+	if a.max > hi {
+		a.max = hi
+	}
+	if a.intervals {
+		a.clipIntervals(lo, hi)
+	}
+	return dropped
+}
+
+// clipIntervals removes the intervals of a which start before lo or after
+// hi. The latest timestamp becomes the end of the last interval left, if
+// that's after hi.
+func (a *Accumulator) clipIntervals(lo, hi int64) {
+	n := 0
+	for i, start := range a.starts {
+		if start < lo || start > hi {
+			continue
+		}
+		a.starts[n], a.ends[n] = start, a.ends[i]
+		if a.ends[i] > a.max {
+			a.max = a.ends[i]
+		}
+		n += 1
+	}
+	a.starts, a.ends = a.starts[:n], a.ends[:n]
+}
+
+// lastInBin returns the latest timestamp which falls into the bin starting at
+// bin.
+func (a *Accumulator) lastInBin(bin int64) int64 {
+	next := a.binnerOf().Next(bin)
+	if next == math.MaxInt64 {
+		return next
+	}
+	return next - 1
+}
@@ -0,0 +1,296 @@
+package tbin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AggregateKind is what an Aggregate computes over the values in a bin.
+type AggregateKind int
+
+const (
+	AggCount AggregateKind = iota
+	AggSum
+	AggMin
+	AggMax
+	AggMean
+	AggQuantile
+)
+
+// Aggregate summarizes a bin as a single number: the count of timestamps in
+// it, or a statistic of the values which came along with them.
+type Aggregate struct {
+	Kind AggregateKind
+	// Q is the quantile computed by an AggQuantile, e.g. 0.95 for p95.
+	Q float64
+	// Name is the aggregate as written, e.g. "p95".
+	Name string
+}
+
+// ParseAggregate parses the name of an aggregate, which is one of "count",
+// "sum", "min", "max", "mean" (or "avg"), or "pNN" for the NN'th percentile,
+// e.g. "p50", "p95", or "p99.9".
+func ParseAggregate(s string) (Aggregate, error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	switch name {
+	case "count":
+		return Aggregate{Kind: AggCount, Name: name}, nil
+	case "sum":
+		return Aggregate{Kind: AggSum, Name: name}, nil
+	case "min":
+		return Aggregate{Kind: AggMin, Name: name}, nil
+	case "max":
+		return Aggregate{Kind: AggMax, Name: name}, nil
+	case "mean", "avg":
+		return Aggregate{Kind: AggMean, Name: "mean"}, nil
+	}
+	if strings.HasPrefix(name, "p") {
+		pct, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && pct >= 0 && pct <= 100 {
+			return Aggregate{Kind: AggQuantile, Q: pct / 100, Name: name}, nil
+		}
+	}
+	return Aggregate{}, fmt.Errorf("unknown aggregate %q, must be one of count, sum, min, max, mean, or a percentile such as p95", s)
+}
+
+// NeedsValues reports whether agg is computed from values rather than just
+// counting timestamps.
+func (agg Aggregate) NeedsValues() bool {
+	return agg.Kind != AggCount
+}
+
+// BinValues keeps the statistics of the values which came along with the
+// timestamps in a bin, such as the latency of each request.
+type BinValues struct {
+	Count int64
+	Sum   float64
+	Min   float64
+	Max   float64
+	// sketch is only kept when quantiles of the values are needed.
+	sketch *QuantileSketch
+}
+
+// NewBinValues creates an empty BinValues, which can compute quantiles if
+// quantiles is set.
+func NewBinValues(quantiles bool) *BinValues {
+	v := &BinValues{}
+	if quantiles {
+		v.sketch = &QuantileSketch{}
+	}
+	return v
+}
+
+// Add adds x to the values of v.
+func (v *BinValues) Add(x float64) {
+	if v.Count == 0 || x < v.Min {
+		v.Min = x
+	}
+	if v.Count == 0 || x > v.Max {
+		v.Max = x
+	}
+	v.Count += 1
+	v.Sum += x
+	if v.sketch != nil {
+		v.sketch.Add(x)
+	}
+}
+
+// Merge adds the values of other to v.
+func (v *BinValues) Merge(other *BinValues) {
+	if other.Count == 0 {
+		return
+	}
+	if v.Count == 0 || other.Min < v.Min {
+		v.Min = other.Min
+	}
+	if v.Count == 0 || other.Max > v.Max {
+		v.Max = other.Max
+	}
+	v.Count += other.Count
+	v.Sum += other.Sum
+	if v.sketch != nil && other.sketch != nil {
+		v.sketch.Merge(other.sketch)
+	}
+}
+
+// Aggregate computes agg over the values of v. It returns false if v has no
+// values for agg to summarize, or can't compute quantiles.
+func (v *BinValues) Aggregate(agg Aggregate) (float64, bool) {
+	switch agg.Kind {
+	case AggCount:
+		return float64(v.Count), true
+	case AggSum:
+		return v.Sum, true
+	}
+	if v.Count == 0 {
+		return 0, false
+	}
+	switch agg.Kind {
+	case AggMin:
+		return v.Min, true
+	case AggMax:
+		return v.Max, true
+	case AggMean:
+		return v.Sum / float64(v.Count), true
+	case AggQuantile:
+		if v.sketch == nil {
+			return 0, false
+		}
+		// The sketch is only accurate relative to each value, so keep its
+		// estimates within the range of the values.
+		return math.Max(v.Min, math.Min(v.Max, v.sketch.Quantile(agg.Q))), true
+	}
+	return 0, false
+}
+
+// SKETCH_EXACT_VALUES is how many values a QuantileSketch holds on to, and
+// computes exact quantiles of, before switching to estimating them.
+const SKETCH_EXACT_VALUES = 256
+
+// SKETCH_RELATIVE_ACCURACY bounds the error of the quantiles estimated by a
+// QuantileSketch, relative to the value of the quantile.
+const SKETCH_RELATIVE_ACCURACY = 0.01
+
+var sketchGamma = (1 + SKETCH_RELATIVE_ACCURACY) / (1 - SKETCH_RELATIVE_ACCURACY)
+
+// QuantileSketch computes quantiles of a stream of values in bounded memory.
+// Up to SKETCH_EXACT_VALUES values are kept, giving exact quantiles. Beyond
+// that values are counted in buckets whose bounds grow exponentially, as in
+// DDSketch, so that estimates are within SKETCH_RELATIVE_ACCURACY of the
+// true value no matter how the values are distributed. Sketches can be
+// merged without losing accuracy, so each goroutine can keep its own.
+type QuantileSketch struct {
+	exact  []float64
+	sorted bool
+	// pos and neg count the positive and negative values in each bucket,
+	// once there are too many values to keep. Bucket i holds magnitudes in
+	// (gamma^(i-1), gamma^i].
+	pos   map[int]int64
+	neg   map[int]int64
+	zeros int64
+	count int64
+}
+
+// Add adds x to s.
+func (s *QuantileSketch) Add(x float64) {
+	s.count += 1
+	if s.pos == nil {
+		s.exact = append(s.exact, x)
+		s.sorted = false
+		if len(s.exact) > SKETCH_EXACT_VALUES {
+			s.toBuckets()
+		}
+		return
+	}
+	s.addToBucket(x, 1)
+}
+
+// Merge adds the values of other to s.
+func (s *QuantileSketch) Merge(other *QuantileSketch) {
+	if other.pos == nil {
+		for _, x := range other.exact {
+			s.Add(x)
+		}
+		return
+	}
+	if s.pos == nil {
+		s.toBuckets()
+	}
+	for i, n := range other.pos {
+		s.pos[i] += n
+	}
+	for i, n := range other.neg {
+		s.neg[i] += n
+	}
+	s.zeros += other.zeros
+	s.count += other.count
+}
+
+// Quantile returns the q'th quantile of the values added to s, or NaN if
+// there are none.
+func (s *QuantileSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	if s.pos == nil {
+		if !s.sorted {
+			sort.Float64s(s.exact)
+			s.sorted = true
+		}
+		pos := q * float64(len(s.exact)-1)
+		lo := int(math.Floor(pos))
+		hi := int(math.Ceil(pos))
+		frac := pos - float64(lo)
+		return s.exact[lo]*(1-frac) + s.exact[hi]*frac
+	}
+	rank := int64(math.Round(q * float64(s.count-1)))
+	var seen int64
+	// Negative values come first, most negative (largest bucket) first.
+	for _, i := range sortedBuckets(s.neg, true) {
+		seen += s.neg[i]
+		if seen > rank {
+			return -bucketValue(i)
+		}
+	}
+	seen += s.zeros
+	if seen > rank {
+		return 0
+	}
+	buckets := sortedBuckets(s.pos, false)
+	for _, i := range buckets {
+		seen += s.pos[i]
+		if seen > rank {
+			return bucketValue(i)
+		}
+	}
+	return bucketValue(buckets[len(buckets)-1])
+}
+
+// toBuckets moves the values held exactly by s into buckets.
+func (s *QuantileSketch) toBuckets() {
+	s.pos = map[int]int64{}
+	s.neg = map[int]int64{}
+	for _, x := range s.exact {
+		s.addToBucket(x, 1)
+	}
+	s.exact = nil
+}
+
+func (s *QuantileSketch) addToBucket(x float64, n int64) {
+	switch {
+	case x > 0:
+		s.pos[bucketIndex(x)] += n
+	case x < 0:
+		s.neg[bucketIndex(-x)] += n
+	default:
+		s.zeros += n
+	}
+}
+
+// bucketIndex returns the bucket holding the magnitude x.
+func bucketIndex(x float64) int {
+	return int(math.Ceil(math.Log(x) / math.Log(sketchGamma)))
+}
+
+// bucketValue returns the magnitude which best stands for the values in
+// bucket i, being within SKETCH_RELATIVE_ACCURACY of every one of them.
+func bucketValue(i int) float64 {
+	return 2 * math.Pow(sketchGamma, float64(i)) / (sketchGamma + 1)
+}
+
+func sortedBuckets(buckets map[int]int64, descending bool) []int {
+	keys := []int{}
+	for i := range buckets {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(a, b int) bool {
+		if descending {
+			return keys[a] > keys[b]
+		}
+		return keys[a] < keys[b]
+	})
+	return keys
+}
@@ -0,0 +1,426 @@
+package tbin
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// binSpec is a parsed bin-size specification such as "15m" or "1M".
+type binSpec struct {
+	Mult   int64
+	Abbrev string
+	// Months is the number of calendar months in each bin, or zero if bins
+	// have a fixed width.
+	Months int64
+	// Width is the width of each bin in nanoseconds; for calendar bins this
+	// is only the average width.
+	Width int64
+}
+
+func parseBinSpec(spec string) (binSpec, error) {
+	mult, abbrev, err := splitSpec(spec)
+	if err != nil {
+		return binSpec{}, err
+	}
+	if mult > math.MaxInt64/ABBREV_TO_DELT[abbrev] {
+		return binSpec{}, fmt.Errorf("bin size %q is too large, bins can be at most %d years", spec, math.MaxInt64/TD_1_year_ns)
+	}
+	return binSpec{
+		Mult:   mult,
+		Abbrev: abbrev,
+		Months: mult * ABBREV_TO_MONTHS[abbrev],
+		Width:  mult * ABBREV_TO_DELT[abbrev],
+	}, nil
+}
+
+// DEFAULT_PRECISION is the precision of timestamps when BinOptions doesn't
+// say otherwise: they're in epoch_ms format, which can hold any time within
+// about 292 million years of 1970.
+const DEFAULT_PRECISION = TD_1_ms_ns
+
+// BinOptions changes where the boundaries between bins fall, and the
+// precision of the timestamps being binned.
+type BinOptions struct {
+	// Location is the time zone in which bins are aligned, so that e.g. day
+	// bins run from local midnight to local midnight, including days which
+	// are 23 or 25 hours long due to daylight saving time. A nil Location
+	// means UTC.
+	Location *time.Location
+	// Origin is a timestamp, in units of Precision, which falls on a bin
+	// boundary; the bins before and after it are aligned to it. For months,
+	// quarters, and years only the month of Origin is used, so that e.g.
+	// quarters can start in February. If Origin is nil, bins are aligned to
+	// 1970-01-01 in Location (or to WeekStart, for weeks) and calendar bins
+	// start at the beginning of the year.
+	Origin *int64
+	// Offset moves every bin boundary later by this many units of
+	// Precision, or earlier if it's negative.
+	Offset int64
+	// WeekStart is the day on which week bins start when there's no Origin.
+	// Note that the zero value is Sunday.
+	WeekStart time.Weekday
+	// Precision is the length in nanoseconds of the unit that timestamps
+	// count since 1970-01-01 UTC, which must divide a second. If zero, it's
+	// DEFAULT_PRECISION. A precision of TD_1_ns, for timestamps in epoch_ns
+	// format, is needed for bins narrower than a millisecond, but can only
+	// hold times from 1677 to 2262.
+	Precision int64
+}
+
+// Binner assigns timestamps to bins of a particular size. Timestamps, and
+// the starts of bins, count units of the Binner's precision since
+// 1970-01-01 UTC.
+//
+// Internally, bins are found on a "wall clock" timeline: the number of units
+// since 1970-01-01 00:00 on the local calendar and clock of the Binner's
+// location. This is what lets day bins start at local midnight no
+// matter how long each day is.
+type Binner struct {
+	spec binSpec
+	loc  *time.Location
+	// origin is the wall clock time at which a bin boundary falls, including
+	// the offset.
+	origin int64
+	// originMonth is the month, counted from January of year 0, at which a
+	// calendar bin starts.
+	originMonth int64
+	offset      int64
+	precision   int64
+	// width is the width of each fixed-width bin in units of precision.
+	width int64
+}
+
+// The weekday of 1970-01-01, which fixed-width bins are aligned to by default.
+const epochWeekday = time.Thursday
+
+// NewBinner creates a Binner for bins of size spec, e.g. "15m" or "1M".
+func NewBinner(spec string, opts BinOptions) (*Binner, error) {
+	bs, err := parseBinSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return newBinner(spec, bs, opts)
+}
+
+// newBinnerOfWidth creates a Binner for fixed-width bins which are width
+// nanoseconds wide.
+func newBinnerOfWidth(width int64, opts BinOptions) (*Binner, error) {
+	return newBinner(fmt.Sprintf("%dns", width), binSpec{Mult: width, Abbrev: "ns", Width: width}, opts)
+}
+
+func newBinner(spec string, bs binSpec, opts BinOptions) (*Binner, error) {
+	precision, err := checkPrecision(opts.Precision)
+	if err != nil {
+		return nil, err
+	}
+	if bs.Width%precision != 0 {
+		return nil, fmt.Errorf("bin size %q is finer than the precision of the timestamps, %s", spec, precisionName(precision))
+	}
+	loc := opts.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	b := &Binner{spec: bs, loc: loc, offset: opts.Offset, precision: precision, width: bs.Width / precision}
+	if opts.Origin != nil {
+		b.origin = b.wall(*opts.Origin)
+		b.originMonth = b.monthIndex(b.origin)
+	} else if bs.Abbrev == "W" {
+		b.origin = int64((opts.WeekStart-epochWeekday+7)%7) * (TD_1_day_ns / precision)
+	}
+	b.origin = addClamped(b.origin, opts.Offset)
+	return b, nil
+}
+
+// Location returns the time zone that the bins of b are aligned in.
+func (b *Binner) Location() *time.Location {
+	return b.loc
+}
+
+// Precision returns the length in nanoseconds of the unit of the timestamps
+// that b bins.
+func (b *Binner) Precision() int64 {
+	return b.precision
+}
+
+// checkPrecision returns precision, or DEFAULT_PRECISION if it's zero, or an
+// error if it doesn't divide a second.
+func checkPrecision(precision int64) (int64, error) {
+	if precision == 0 {
+		return DEFAULT_PRECISION, nil
+	}
+	if precision < 0 || TD_1_sec_ns%precision != 0 {
+		return 0, fmt.Errorf("precision of %dns does not divide a second", precision)
+	}
+	return precision, nil
+}
+
+// precisionName describes precision, e.g. "1ms".
+func precisionName(precision int64) string {
+	for _, abbrev := range []string{"s", "ms", "us", "ns"} {
+		if precision%ABBREV_TO_DELT[abbrev] == 0 {
+			return fmt.Sprintf("%d%s", precision/ABBREV_TO_DELT[abbrev], abbrev)
+		}
+	}
+	return fmt.Sprintf("%dns", precision)
+}
+
+// Bin returns the start of the bin which ts falls into. Any ts may be
+// binned, including those before 1970; if the start of the bin is too early
+// to be held in an int64 then the earliest possible timestamp is returned.
+func (b *Binner) Bin(ts int64) int64 {
+	switch {
+	case b.spec.Months > 0:
+		return b.binMonths(ts)
+	case b.spec.Width%TD_1_day_ns == 0:
+		wall := b.wall(ts)
+		return b.fromWall(addClamped(wall, -b.sinceBinStart(wall)))
+	}
+	// Bins shorter than a day are aligned to the local wall clock, so that
+	// e.g. hour bins in a zone that's offset by a half hour from UTC still
+	// start on the hour. The offset is that of ts itself, so bins on either
+	// side of a daylight saving time transition are aligned correctly.
+	return addClamped(ts, -b.sinceBinStart(b.wall(ts)))
+}
+
+// sinceBinStart returns how far wall is past the start of its fixed-width
+// bin. It's found from the remainders of wall and the origin rather than
+// their difference, which could overflow.
+func (b *Binner) sinceBinStart(wall int64) int64 {
+	width := b.width
+	return floorMod(floorMod(wall, width)-floorMod(b.origin, width), width)
+}
+
+// Next returns the start of the bin following the bin which starts at bin.
+func (b *Binner) Next(bin int64) int64 {
+	width := b.width
+	switch {
+	case b.spec.Months > 0:
+		return b.fromWall(addClamped(b.monthStart(b.binMonth(bin)+b.spec.Months), b.offset))
+	case b.spec.Width%TD_1_day_ns == 0:
+		// Adding days on the wall clock rather than a fixed width handles
+		// days which are 23 or 25 hours long.
+		return b.Bin(b.fromWall(addClamped(b.wall(bin), width)))
+	}
+	next := b.Bin(addClamped(bin, width))
+	if next <= bin {
+		// The wall clock was set back such that the next bin would start
+		// where this one did.
+		next = addClamped(bin, width)
+	}
+	return next
+}
+
+// binMonths floors ts to the start of its calendar bin.
+func (b *Binner) binMonths(ts int64) int64 {
+	return b.fromWall(addClamped(b.monthStart(b.binMonth(ts)), b.offset))
+}
+
+// binMonth returns the month, counted from January of year 0, in which the
+// calendar bin holding ts starts. Calendar bins are aligned so that they
+// start on multiples of their size from the origin month, e.g. by default
+// quarters start in January, April, July, and October.
+func (b *Binner) binMonth(ts int64) int64 {
+	month := b.monthIndex(addClamped(b.wall(ts), -b.offset))
+	return b.originMonth + floorDiv(month-b.originMonth, b.spec.Months)*b.spec.Months
+}
+
+// wall converts ts into the Binner's wall clock timeline.
+func (b *Binner) wall(ts int64) int64 {
+	if b.loc == time.UTC {
+		return ts
+	}
+	_, offset := ToTime(ts, b.precision).In(b.loc).Zone()
+	return addClamped(ts, int64(offset)*(TD_1_sec_ns/b.precision))
+}
+
+// fromWall converts a time on the Binner's wall clock timeline into a
+// timestamp. Wall clock times which are skipped by daylight saving time are
+// moved forward by the length of the skip.
+func (b *Binner) fromWall(wall int64) int64 {
+	if b.loc == time.UTC {
+		return wall
+	}
+	t := ToTime(wall, b.precision).UTC()
+	return fromTimeClamped(time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), b.loc), b.precision)
+}
+
+// monthIndex returns the number of months between January of year 0 and the
+// month containing wall.
+func (b *Binner) monthIndex(wall int64) int64 {
+	t := ToTime(wall, b.precision).UTC()
+	return int64(t.Year())*12 + int64(t.Month()-1)
+}
+
+// monthStart is the inverse of monthIndex, returning the wall clock time at
+// the start of month.
+func (b *Binner) monthStart(month int64) int64 {
+	year := floorDiv(month, 12)
+	return fromTimeClamped(time.Date(int(year), time.Month(month-year*12+1), 1, 0, 0, 0, 0, time.UTC), b.precision)
+}
+
+// BinTimestamps counts the timestamps in tss falling into each bin. Every bin
+// between the first and last timestamp is present in the result, even if no
+// timestamps fall into it.
+func (b *Binner) BinTimestamps(tss []int64) map[int64]int64 {
+	hist := b.BinTimestampsSparse(tss)
+	b.FillGaps(hist)
+	return hist
+}
+
+// FillGaps adds every bin missing from hist between its first and last bin,
+// with a count of zero.
+//
+// Bin boundaries are clamped to math.MinInt64 and math.MaxInt64 rather than
+// overflowing, so no bins are added past the last which starts before
+// math.MaxInt64.
+func (b *Binner) FillGaps(hist map[int64]int64) {
+	if len(hist) == 0 {
+		return
+	}
+	var minbin, maxbin int64 = math.MaxInt64, math.MinInt64
+	for k := range hist {
+		if k < minbin {
+			minbin = k
+		}
+		if k > maxbin {
+			maxbin = k
+		}
+	}
+	cur := minbin
+	for cur < maxbin {
+		next := b.Next(cur)
+		if next <= cur || next > maxbin {
+			// Either the start of the next bin overflowed and was clamped
+			// to math.MaxInt64, or the last bin of hist isn't the start of
+			// a bin and there are no more bins before it.
+			break
+		}
+		cur = next
+		if _, ok := hist[cur]; !ok {
+			hist[cur] = 0
+		}
+	}
+}
+
+// BinTimestampsSparse counts the timestamps in tss falling into each bin, as
+// with BinTimestamps, but only the bins which timestamps fall into are
+// present in the result. This keeps the result small no matter how far apart
+// the timestamps are; see Gaps for finding the bins which were left out.
+func (b *Binner) BinTimestampsSparse(tss []int64) map[int64]int64 {
+	hist := map[int64]int64{}
+	for _, ts := range tss {
+		hist[b.Bin(ts)] += 1
+	}
+	return hist
+}
+
+// CountBins returns the number of bins from the one holding first through to
+// the one holding last. For day bins in a zone with daylight saving time the
+// count is rounded, since not every day is 24 hours long.
+func (b *Binner) CountBins(first, last int64) int64 {
+	if last < first {
+		return 0
+	}
+	if b.spec.Months > 0 {
+		return (b.binMonth(last)-b.binMonth(first))/b.spec.Months + 1
+	}
+	// Bins may span more than the int64 range, so count them as a float64.
+	n := math.Round((float64(b.Bin(last))-float64(b.Bin(first)))/float64(b.width)) + 1
+	if n >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return int64(n)
+}
+
+// Gap is a run of consecutive empty bins, starting at Start and ending where
+// the next non-empty bin starts at End.
+type Gap struct {
+	Start int64
+	End   int64
+	// Bins is the number of empty bins in the gap.
+	Bins int64
+}
+
+// Gaps returns the runs of bins which are missing from bins, such as those
+// returned by BinTimestampsSparse, between its first and last bin.
+func (b *Binner) Gaps(bins map[int64]int64) []Gap {
+	keys := []int64{}
+	for k := range bins {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	gaps := []Gap{}
+	for i := 1; i < len(keys); i++ {
+		next := b.Next(keys[i-1])
+		if next < keys[i] {
+			gaps = append(gaps, Gap{Start: next, End: keys[i], Bins: b.CountBins(next, keys[i]) - 1})
+		}
+	}
+	return gaps
+}
+
+// floorDiv divides a by b, rounding toward negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q -= 1
+	}
+	return q
+}
+
+// floorMod returns the remainder of dividing a by b, which is always between
+// 0 and b for positive b.
+func floorMod(a, b int64) int64 {
+	m := a % b
+	if m < 0 {
+		m += b
+	}
+	return m
+}
+
+// addClamped returns a+b, or MinInt64 or MaxInt64 if the sum would overflow.
+func addClamped(a, b int64) int64 {
+	c := a + b
+	switch {
+	case b > 0 && c < a:
+		return math.MaxInt64
+	case b < 0 && c > a:
+		return math.MinInt64
+	}
+	return c
+}
+
+// ToTime converts ts, a timestamp counting units of precision since
+// 1970-01-01 UTC, into a time.Time.
+func ToTime(ts, precision int64) time.Time {
+	perSec := TD_1_sec_ns / precision
+	return time.Unix(floorDiv(ts, perSec), floorMod(ts, perSec)*precision).UTC()
+}
+
+// FromTime converts t into a timestamp counting units of precision since
+// 1970-01-01 UTC, dropping any fraction of a unit. It fails if t is too far
+// from 1970 to be held in an int64.
+func FromTime(t time.Time, precision int64) (int64, error) {
+	first, last := ToTime(math.MinInt64, precision), ToTime(math.MaxInt64, precision)
+	if t.Before(first) || t.After(last.Add(time.Duration(precision-1))) {
+		return 0, fmt.Errorf("%s is outside the range of timestamps which can be binned, %s to %s",
+			t.Format(time.RFC3339), first.Format(time.RFC3339), last.Format(time.RFC3339))
+	}
+	return fromTimeClamped(t, precision), nil
+}
+
+// fromTimeClamped converts t into a timestamp as FromTime does, but returns
+// MinInt64 or MaxInt64 for times which are too early or too late.
+func fromTimeClamped(t time.Time, precision int64) int64 {
+	perSec := TD_1_sec_ns / precision
+	sec, sub := t.Unix(), int64(t.Nanosecond())/precision
+	switch {
+	case sec < math.MinInt64/perSec:
+		return math.MinInt64
+	case sec > (math.MaxInt64-sub)/perSec:
+		return math.MaxInt64
+	}
+	return sec*perSec + sub
+}
@@ -0,0 +1,149 @@
+package tbin
+
+import (
+	"math"
+	"sort"
+)
+
+// NICE_BIN_SIZES are the bin sizes which EstimateBinSize chooses between,
+// from smallest to largest. Each is a small round multiple of a unit, so that
+// bin boundaries land on times that people would pick themselves.
+var NICE_BIN_SIZES []string = []string{
+	"1ns", "2ns", "5ns", "10ns", "20ns", "50ns", "100ns", "200ns", "500ns",
+	"1us", "2us", "5us", "10us", "20us", "50us", "100us", "200us", "500us",
+	"1ms", "2ms", "5ms", "10ms", "20ms", "50ms", "100ms", "200ms", "500ms",
+	"1s", "2s", "5s", "10s", "15s", "30s",
+	"1m", "2m", "5m", "10m", "15m", "30m",
+	"1h", "2h", "3h", "6h", "12h",
+	"1D", "2D",
+	"1W", "2W",
+	"1M", "3M", "6M",
+	"1Y", "2Y", "5Y", "10Y", "20Y", "50Y", "100Y",
+}
+
+// DEFAULT_TARGET_BINS is the number of bins EstimateBinSize aims for when it
+// isn't told otherwise.
+const DEFAULT_TARGET_BINS = 100
+
+// EstimateBinSize returns two abbreviations for duration. The first is a bin
+// spec from NICE_BIN_SIZES which divides the span of the timestamps into
+// about targetBins bins, while the second is the ChartJS compatible unit of
+// that spec. For example, 2 days of data with a target of 100 bins is split
+// into 30 minute bins. The timestamps are in epoch_ms format.
+func EstimateBinSize(tss []int64, targetBins int) (string, string) {
+	if len(tss) == 0 {
+		return estimateBinSizeForSpan(0, 0, targetBins, DEFAULT_PRECISION, DEFAULT_PRECISION)
+	}
+	lo, hi := tss[0], tss[0]
+	for _, ts := range tss {
+		if ts < lo {
+			lo = ts
+		}
+		if ts > hi {
+			hi = ts
+		}
+	}
+	return estimateBinSizeForSpan(lo, hi, targetBins, DEFAULT_PRECISION, DEFAULT_PRECISION)
+}
+
+// EstimateBinSize is like the EstimateBinSize function, for the timestamps
+// added to a. The size is a multiple of the width of the bins of a, so that
+// they can be re-binned into it, even if that makes fewer bins than
+// targetBins.
+func (a *Accumulator) EstimateBinSize(targetBins int) (string, string) {
+	return estimateBinSizeForSpan(a.Min(), a.Max(), targetBins, a.precision, a.granularity())
+}
+
+// estimateBinSizeForSpan picks the bin size for timestamps from first to
+// last, in units of precision, which is a multiple of granularity
+// nanoseconds.
+func estimateBinSizeForSpan(first, last int64, targetBins int, precision, granularity int64) (string, string) {
+	if targetBins < 1 {
+		targetBins = DEFAULT_TARGET_BINS
+	}
+	// The span is a float64 since it may not fit in an int64, e.g. from
+	// before 1970 until after 2200.
+	span := (float64(last) - float64(first)) * float64(precision)
+	return nearestNiceBinSize(span/float64(targetBins), granularity)
+}
+
+// EstimateBinSizeFD returns the same as EstimateBinSize, but picks the bin
+// size using the Freedman–Diaconis rule: a width of 2*IQR/cbrt(n), where IQR
+// is the interquartile range of the timestamps. This accounts for the density
+// of the data, so a few outliers far from the bulk of the timestamps don't
+// make the bins too wide. The timestamps are in epoch_ms format.
+func EstimateBinSizeFD(tss []int64) (string, string) {
+	if len(tss) < 2 {
+		return nearestNiceBinSize(0, DEFAULT_PRECISION)
+	}
+	sorted := make([]int64, len(tss))
+	copy(sorted, tss)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	iqr := quantile(sorted, 0.75) - quantile(sorted, 0.25)
+	return estimateBinSizeFD(iqr, int64(len(sorted)), sorted[0], sorted[len(sorted)-1], DEFAULT_PRECISION, DEFAULT_PRECISION)
+}
+
+// EstimateBinSizeFD is like the EstimateBinSizeFD function, for the
+// timestamps added to a. The interquartile range is only as precise as the
+// bins of a, and as with EstimateBinSize the size is a multiple of their
+// width.
+func (a *Accumulator) EstimateBinSizeFD() (string, string) {
+	if a.Count() < 2 {
+		return nearestNiceBinSize(0, a.granularity())
+	}
+	iqr := float64(a.Quantile(0.75)) - float64(a.Quantile(0.25))
+	return estimateBinSizeFD(iqr, a.Count(), a.Min(), a.Max(), a.precision, a.granularity())
+}
+
+// estimateBinSizeFD picks the bin size for n timestamps from first to last
+// with an interquartile range of iqr, all in units of precision, which is a
+// multiple of granularity nanoseconds.
+func estimateBinSizeFD(iqr float64, n int64, first, last int64, precision, granularity int64) (string, string) {
+	width := 2 * iqr * float64(precision) / math.Cbrt(float64(n))
+	if width <= 0 {
+		// More than half the timestamps are identical, so fall back to
+		// splitting the whole span.
+		return estimateBinSizeForSpan(first, last, DEFAULT_TARGET_BINS, precision, granularity)
+	}
+	return nearestNiceBinSize(width, granularity)
+}
+
+// quantile returns the q'th quantile of sorted, interpolating between
+// neighbouring values.
+func quantile(sorted []int64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	frac := pos - float64(lo)
+	return float64(sorted[lo])*(1-frac) + float64(sorted[hi])*frac
+}
+
+// nearestNiceBinSize returns the spec from NICE_BIN_SIZES whose width, in
+// nanoseconds, is closest to width in ratio, along with its ChartJS unit.
+// Specs which aren't a multiple of granularity nanoseconds are skipped, such
+// as those finer than the precision of the timestamps or than the bins they
+// were counted in.
+func nearestNiceBinSize(width float64, granularity int64) (string, string) {
+	best := ""
+	bestDist := math.Inf(1)
+	for _, spec := range NICE_BIN_SIZES {
+		mult, delt, _ := ParseSpec(spec)
+		size := mult * delt
+		if delt >= TD_1_month_ns {
+			// Calendar bins are a whole number of days, just not always the
+			// same number.
+			size = TD_1_day_ns
+		}
+		if size%granularity != 0 {
+			continue
+		}
+		// Compare in log space, so that being 2x too wide is as bad as being
+		// 2x too narrow.
+		dist := math.Abs(math.Log(float64(mult*delt)) - math.Log(math.Max(width, 1)))
+		if dist < bestDist {
+			best, bestDist = spec, dist
+		}
+	}
+	_, abbrev, _ := splitSpec(best)
+	return best, ABBREV_TO_CHARTJS_UNIT[abbrev]
+}
@@ -0,0 +1,85 @@
+package tbin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// IntervalBins is what's known of the intervals, such as requests or jobs,
+// which overlap each bin.
+type IntervalBins struct {
+	// Active is the number of intervals which were active at any time during
+	// each bin.
+	Active map[int64]int64
+	// Peak is the most intervals which were active at once during each bin.
+	Peak map[int64]int64
+}
+
+// BinIntervals bins the intervals which start at each of starts and end at
+// the matching one of ends. An interval is active from its start up to but
+// not including its end, so one which ends as another starts doesn't
+// overlap it; an interval with no duration is taken to last one unit of the
+// precision of b. Only bins in which some interval was active are returned.
+//
+// The intervals are swept in order of their starts and ends, so the time
+// taken only depends on the number of intervals and bins rather than on how
+// many intervals overlap. starts and ends are sorted in place.
+func (b *Binner) BinIntervals(starts, ends []int64) (IntervalBins, error) {
+	if len(starts) != len(ends) {
+		return IntervalBins{}, fmt.Errorf("got %d starts of intervals but %d ends", len(starts), len(ends))
+	}
+	for i := range starts {
+		if ends[i] < starts[i] {
+			return IntervalBins{}, fmt.Errorf("interval %d ends at %d, before it starts at %d", i, ends[i], starts[i])
+		}
+		if ends[i] == starts[i] {
+			ends[i] = addClamped(ends[i], 1)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	sort.Slice(ends, func(i, j int) bool { return ends[i] < ends[j] })
+
+	ib := IntervalBins{Active: map[int64]int64{}, Peak: map[int64]int64{}}
+	if len(starts) == 0 {
+		return ib, nil
+	}
+	var cur int64
+	bin := b.Bin(starts[0])
+	ib.Active[bin], ib.Peak[bin] = 0, 0
+	i, j := 0, 0
+	for i < len(starts) || j < len(ends) {
+		// Ends come before starts at the same time, so that back-to-back
+		// intervals aren't counted as running at once. An interval is last
+		// active just before it ends, so that's the bin its end falls in.
+		end := j < len(ends) && (i >= len(starts) || ends[j] <= starts[i])
+		var k int64
+		if end {
+			k = b.Bin(ends[j] - 1)
+		} else {
+			k = b.Bin(starts[i])
+		}
+		if k != bin {
+			// Nothing starts or ends in the bins in between, so the intervals
+			// which are active stay active throughout them.
+			if cur > 0 {
+				for n := b.Next(bin); n < k; n = b.Next(n) {
+					ib.Active[n], ib.Peak[n] = cur, cur
+				}
+			}
+			bin = k
+			ib.Active[bin], ib.Peak[bin] = cur, cur
+		}
+		if end {
+			cur -= 1
+			j += 1
+			continue
+		}
+		cur += 1
+		i += 1
+		ib.Active[bin] += 1
+		if cur > ib.Peak[bin] {
+			ib.Peak[bin] = cur
+		}
+	}
+	return ib, nil
+}
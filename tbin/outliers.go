@@ -0,0 +1,32 @@
+package tbin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ClipPercentile removes outliers from tss, dropping the timestamps below the
+// pct'th percentile and above the (100-pct)'th percentile. This keeps a few
+// stray timestamps, e.g. a zeroed date of 1970-01-01, from stretching the
+// histogram over a span that is mostly empty. The remaining timestamps are
+// returned along with the range that they fall within.
+func ClipPercentile(tss []int64, pct float64) ([]int64, int64, int64, error) {
+	if pct < 0 || pct >= 50 {
+		return nil, 0, 0, fmt.Errorf("percentile to clip %v must be at least 0 and less than 50", pct)
+	}
+	if len(tss) == 0 {
+		return tss, 0, 0, nil
+	}
+	sorted := make([]int64, len(tss))
+	copy(sorted, tss)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	lo := sorted[int(pct/100*float64(len(sorted)-1))]
+	hi := sorted[len(sorted)-1-int(pct/100*float64(len(sorted)-1))]
+	kept := []int64{}
+	for _, ts := range tss {
+		if ts >= lo && ts <= hi {
+			kept = append(kept, ts)
+		}
+	}
+	return kept, lo, hi, nil
+}
@@ -2,11 +2,13 @@ package tbin
 
 import (
 	"fmt"
+	"math/big"
 	"sort"
-	"strconv"
+	"strings"
 	"unicode"
 )
 
+// The widths of units in milliseconds, the unit of epoch_ms timestamps.
 const TD_1_ms int64 = 1
 const TD_1_sec int64 = 1000 * TD_1_ms
 const TD_1_min int64 = 60 * TD_1_sec
@@ -14,9 +16,43 @@ const TD_1_hr int64 = 60 * TD_1_min
 const TD_1_day int64 = 24 * TD_1_hr
 const TD_1_week int64 = 7 * TD_1_day
 
+// The widths of units in nanoseconds, the same as time.Duration, which is how
+// durations such as bin sizes are given. Timestamps are usually in coarser
+// units though; see BinOptions.Precision.
+const TD_1_ns int64 = 1
+const TD_1_us_ns int64 = 1000 * TD_1_ns
+const TD_1_ms_ns int64 = 1000 * TD_1_us_ns
+const TD_1_sec_ns int64 = 1000 * TD_1_ms_ns
+const TD_1_min_ns int64 = 60 * TD_1_sec_ns
+const TD_1_hr_ns int64 = 60 * TD_1_min_ns
+const TD_1_day_ns int64 = 24 * TD_1_hr_ns
+const TD_1_week_ns int64 = 7 * TD_1_day_ns
+
+// Months, quarters, and years don't have a fixed width, so these are only the
+// average widths of each in the Gregorian calendar. Binning by these units
+// always uses real calendar boundaries.
+const TD_1_month_ns int64 = 2629746 * TD_1_sec_ns
+const TD_1_quarter_ns int64 = 3 * TD_1_month_ns
+const TD_1_year_ns int64 = 12 * TD_1_month_ns
+
 var TIMEDELTA_ABBREVS map[string]string = map[string]string{
 	"Y":            "Y", // year
 	"y":            "Y",
+	"YS":           "Y",
+	"A":            "Y",
+	"AS":           "Y",
+	"years":        "Y",
+	"year":         "Y",
+	"Q":            "Q", // quarter
+	"QS":           "Q",
+	"q":            "Q",
+	"quarters":     "Q",
+	"quarter":      "Q",
+	"M":            "M", // month
+	"MS":           "M",
+	"months":       "M",
+	"month":        "M",
+	"mon":          "M",
 	"W":            "W", // week
 	"w":            "W",
 	"D":            "D", // day
@@ -42,155 +78,445 @@ var TIMEDELTA_ABBREVS map[string]string = map[string]string{
 	"milli":        "ms",
 	"millis":       "ms",
 	"l":            "ms",
+	"us":           "us",
+	"µs":           "us", // micro sign
+	"μs":           "us", // Greek mu
+	"U":            "us",
+	"micros":       "us",
+	"microsecond":  "us",
+	"microseconds": "us",
+	"ns":           "ns",
+	"N":            "ns",
+	"nanos":        "ns",
+	"nanosecond":   "ns",
+	"nanoseconds":  "ns",
 }
 
 var ABBREV_TO_DELT map[string]int64 = map[string]int64{
-	"Y":  365 * TD_1_day,
-	"W":  TD_1_week,
-	"D":  TD_1_day,
-	"h":  TD_1_hr,
-	"m":  TD_1_min,
-	"s":  TD_1_sec,
-	"ms": TD_1_ms,
+	"Y":  TD_1_year_ns,
+	"Q":  TD_1_quarter_ns,
+	"M":  TD_1_month_ns,
+	"W":  TD_1_week_ns,
+	"D":  TD_1_day_ns,
+	"h":  TD_1_hr_ns,
+	"m":  TD_1_min_ns,
+	"s":  TD_1_sec_ns,
+	"ms": TD_1_ms_ns,
+	"us": TD_1_us_ns,
+	"ns": TD_1_ns,
 }
 
-var ABBREV_LARGE_TO_SMALL []string = []string{"Y", "W", "D", "h", "m", "s", "ms"}
+var ABBREV_LARGE_TO_SMALL []string = []string{"Y", "Q", "M", "W", "D", "h", "m", "s", "ms", "us", "ns"}
+
+// ABBREV_TO_MONTHS holds the abbreviations of units which are a whole number
+// of calendar months, and so must be binned on calendar boundaries rather
+// than by a fixed width.
+var ABBREV_TO_MONTHS map[string]int64 = map[string]int64{
+	"Y": 12,
+	"Q": 3,
+	"M": 1,
+}
 
 // Maps the time abbreviations originally taken from Pandas onto the time
 // abbreviations needed by ChartJS:
 // https://www.chartjs.org/docs/3.0.2/axes/cartesian/time.html#time-units
 var ABBREV_TO_CHARTJS_UNIT map[string]string = map[string]string{
 	"Y":  "year",
+	"Q":  "quarter",
+	"M":  "month",
 	"W":  "week",
 	"D":  "day",
 	"h":  "hour",
 	"m":  "minute",
 	"s":  "second",
 	"ms": "millisecond",
+	// ChartJS has no unit smaller than a millisecond.
+	"us": "millisecond",
+	"ns": "millisecond",
 }
 
 // BinTimestamp takes a timestamp in epoch_ms format and returns that same
 // timestamp floor-ed down to the nearest 'frequency' you provided, effectively
 // giving you the "bin" where this timestamp belongs in a histogram with bins
-// of size 'frequency'. If 'frequency' does not stand for a known bin-size,
-// then an error is returned.
+// of size 'frequency'. Months, quarters, and years are floor-ed to the start
+// of the calendar month, quarter, or year in UTC. If 'frequency' does not
+// stand for a known bin-size, then an error is returned.
 func BinTimestamp(ts int64, spec string) (int64, error) {
-	mult, delt, err := ParseSpec(spec)
+	b, err := NewBinner(spec, BinOptions{})
 	if err != nil {
 		return 0, err
 	}
-	d := delt * mult
-	return (ts / d) * d, nil
+	return b.Bin(ts), nil
 }
 
+// BinTimestamps counts the timestamps in tss falling into each bin of size
+// spec, with bins aligned in UTC. See Binner.BinTimestamps.
 func BinTimestamps(tss []int64, spec string) (map[int64]int64, error) {
-	hist := map[int64]int64{}
-	for _, ts := range tss {
-		bin, err := BinTimestamp(ts, spec)
-		if err != nil {
-			return nil, err
-		}
-		if _, ok := hist[bin]; !ok {
-			hist[bin] = 0
-		}
-		hist[bin] = hist[bin] + 1
-	}
-	sort.SliceStable(tss, func(i, j int) bool { return tss[i] < tss[j] })
-	mult, basedelt, err := ParseSpec(spec)
+	b, err := NewBinner(spec, BinOptions{})
 	if err != nil {
 		return nil, err
 	}
-	delt := mult * basedelt
-	minbin, _ := BinTimestamp(tss[0], spec)
-	maxbin, _ := BinTimestamp(tss[len(tss)-1], spec)
-	cur := minbin
-	for cur < maxbin {
-		cur += delt
-		cb, _ := BinTimestamp(cur, spec)
-		if _, ok := hist[cb]; !ok {
-			hist[cb] = 0
-		}
+	return b.BinTimestamps(tss), nil
+}
+
+// BinIntervals bins the intervals between each of starts and the matching
+// one of ends into bins of size spec, with bins aligned in UTC. See
+// Binner.BinIntervals.
+func BinIntervals(starts, ends []int64, spec string) (IntervalBins, error) {
+	b, err := NewBinner(spec, BinOptions{})
+	if err != nil {
+		return IntervalBins{}, err
 	}
-	return hist, nil
+	return b.BinIntervals(starts, ends)
 }
 
 type ChartJSDatapoint struct {
 	X interface{} `json:"x"`
 	Y interface{} `json:"y"`
+	// Gap is set on the datapoints which mark a run of empty bins that were
+	// left out of the data; such datapoints have no Y.
+	Gap *ChartJSGap `json:"gap,omitempty"`
 }
+
+// ChartJSGap describes a run of empty bins which were left out of the data
+// given to ChartJS.
+type ChartJSGap struct {
+	// End is the start of the next non-empty bin, in epoch_ms format.
+	End  interface{} `json:"end"`
+	Bins int64       `json:"bins"`
+}
+
+// ChartJSDataset is one series of bins drawn on the chart, such as the count
+// of timestamps in each bin or the p95 of their values.
+type ChartJSDataset struct {
+	// Label describes the Y values of the dataset, e.g. "p95 of latency".
+	Label string `json:"label"`
+	// Aggregate is the name of the Aggregate giving the Y values, e.g. "p95".
+	Aggregate string `json:"aggregate"`
+	// Series names the group of timestamps the dataset is of, when they're
+	// grouped, e.g. the service whose log lines they came from.
+	Series string             `json:"series,omitempty"`
+	Data   []ChartJSDatapoint `json:"data"`
+}
+
 type ChartJSCtx struct {
-	Unit string             `json:"unit"`
-	Data []ChartJSDatapoint `json:"data"`
+	Unit     string           `json:"unit"`
+	Datasets []ChartJSDataset `json:"datasets"`
+	// BinSize is the spec of the bins, e.g. "15m".
+	BinSize string `json:"bin_size"`
+	// BinTZ is the name of the time zone in which the bins were aligned.
+	BinTZ string `json:"bin_tz"`
 }
 
-func FormatBinDataForChartJS(bins map[int64]int64) (ChartJSCtx, error) {
-	ctx := ChartJSCtx{}
+// FormatBinDataForChartJS converts bins of size spec, whose starts are in
+// epoch_ms format, into the data needed to draw them with ChartJS.
+func FormatBinDataForChartJS(bins map[int64]int64, spec string) (ChartJSCtx, error) {
+	return FormatSparseBinDataForChartJS(bins, spec, nil)
+}
+
+// FormatSparseBinDataForChartJS is like FormatBinDataForChartJS, but for bins
+// which only hold some of the bins in their range, such as those returned by
+// Binner.BinTimestampsSparse. A datapoint without a value marks the start of
+// each of gaps, so that the chart shows a break instead of drawing the bins
+// on either side of the gap next to each other.
+func FormatSparseBinDataForChartJS(bins map[int64]int64, spec string, gaps []Gap) (ChartJSCtx, error) {
+	count := Aggregate{Kind: AggCount, Name: "count"}
+	return FormatAggregatesForChartJS(bins, nil, []Aggregate{count}, spec, DEFAULT_PRECISION, gaps)
+}
+
+// FormatAggregatesForChartJS is like FormatSparseBinDataForChartJS, but with
+// a dataset for each of aggs, and for bins whose starts are in units of
+// precision. The start of each bin is given to ChartJS in epoch_ms format,
+// with a fractional part for bins smaller than a millisecond. The count of
+// each of bins is taken from bins, while the other aggregates are computed
+// from its values in values, such as those returned by Accumulator.Values.
+// Bins without values have a sum of zero, and no Y for the other aggregates.
+func FormatAggregatesForChartJS(bins map[int64]int64, values map[int64]*BinValues, aggs []Aggregate, spec string, precision int64, gaps []Gap) (ChartJSCtx, error) {
+	_, abbrev, err := splitSpec(spec)
+	if err != nil {
+		return ChartJSCtx{}, err
+	}
+	ctx := ChartJSCtx{BinSize: spec, Datasets: []ChartJSDataset{}}
 	keys := []int64{}
 	for k := range bins {
 		keys = append(keys, k)
 	}
 	sort.SliceStable(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	_, jsunit := EstimateBinSize(keys)
-	for _, k := range keys {
-		v := bins[k]
-		ctx.Data = append(ctx.Data, ChartJSDatapoint{X: k, Y: v})
+	sort.SliceStable(gaps, func(i, j int) bool { return gaps[i].Start < gaps[j].Start })
+	for _, agg := range aggs {
+		if agg.NeedsValues() && values == nil {
+			return ChartJSCtx{}, fmt.Errorf("cannot chart the %s of bins without values", agg.Name)
+		}
+		ds := ChartJSDataset{Label: agg.Name, Aggregate: agg.Name, Data: []ChartJSDatapoint{}}
+		gs := gaps
+		for _, k := range keys {
+			for len(gs) > 0 && gs[0].Start < k {
+				g := gs[0]
+				ds.Data = append(ds.Data, ChartJSDatapoint{X: chartJSTime(g.Start, precision), Gap: &ChartJSGap{End: chartJSTime(g.End, precision), Bins: g.Bins}})
+				gs = gs[1:]
+			}
+			ds.Data = append(ds.Data, ChartJSDatapoint{X: chartJSTime(k, precision), Y: aggregateBin(agg, bins[k], values[k])})
+		}
+		ctx.Datasets = append(ctx.Datasets, ds)
 	}
-	ctx.Unit = jsunit
+	ctx.Unit = ABBREV_TO_CHARTJS_UNIT[abbrev]
 	return ctx, nil
 }
 
-// EstimateBinSize returns two abbreviations for duration. The first is an
-// abbreviation appropriate to get a timedelta duration from ABBREV_TO_DELT,
-// while the second is a ChartJS compatible abbreviation.
-// Note that this isn't a very good way to estimate the bin size, as it doesn't
-// account for the density of data over the minimum time span. For example, if
-// the data spans a period of 2 days, this'll bin that data into just two bins,
-// one for each day, because the 48 hour duration of the data divides nicely
-// into day long segments.
-func EstimateBinSize(tss []int64) (string, string) {
-	sort.SliceStable(tss, func(i, j int) bool { return tss[i] < tss[j] })
-	var dur int64 = tss[len(tss)-1] - tss[0]
-	unit := "ms"
-	for _, abrv := range ABBREV_LARGE_TO_SMALL {
-		var delt int64 = ABBREV_TO_DELT[abrv]
-		// The smallest unit which still divides the duration of the bins into
-		// a whole integer
-		if (dur / delt) < 1 {
+// FormatIntervalsForChartJS converts the bins of intervals, such as those
+// returned by Binner.BinIntervals, into the data needed to draw them with
+// ChartJS: a dataset of the number of intervals active in each bin, and one
+// of the peak number active at once. As with FormatSparseBinDataForChartJS, a
+// datapoint without a value marks the start of each of gaps. The starts of
+// the bins are in units of precision.
+func FormatIntervalsForChartJS(ib IntervalBins, spec string, precision int64, gaps []Gap) (ChartJSCtx, error) {
+	active, err := FormatAggregatesForChartJS(ib.Active, nil, []Aggregate{{Kind: AggCount, Name: "active"}}, spec, precision, gaps)
+	if err != nil {
+		return active, err
+	}
+	peak, err := FormatAggregatesForChartJS(ib.Peak, nil, []Aggregate{{Kind: AggCount, Name: "peak"}}, spec, precision, gaps)
+	if err != nil {
+		return peak, err
+	}
+	active.Datasets[0].Label = "intervals active"
+	peak.Datasets[0].Label = "peak concurrency"
+	active.Datasets = append(active.Datasets, peak.Datasets...)
+	return active, nil
+}
+
+// aggregateBin returns the Y of a bin holding count timestamps with the given
+// values for agg, or nil if there's nothing to aggregate.
+func aggregateBin(agg Aggregate, count int64, values *BinValues) interface{} {
+	if agg.Kind == AggCount {
+		return count
+	}
+	if values == nil {
+		values = &BinValues{}
+	}
+	y, ok := values.Aggregate(agg)
+	if !ok {
+		return nil
+	}
+	return y
+}
+
+// ParseSpec splits a bin-size specification such as "30m" into a multiplier
+// and the width in nanoseconds of its unit. For months, quarters, and years
+// the width is only the average width of that unit.
+//
+// Besides a single multiple of a unit, a spec may be a compound or fractional
+// duration such as "1h30m", "2d12h", or "1.5h" (which covers the syntax of
+// Go's time.ParseDuration), or an ISO-8601 duration such as "PT90M". These
+// are reduced to a whole multiple of the smallest unit they need, so "1h30m"
+// becomes 90 minutes.
+func ParseSpec(unit string) (mult int64, delt int64, err error) {
+	mult, abbrev, err := splitSpec(unit)
+	if err != nil {
+		return 0, 0, err
+	}
+	return mult, ABBREV_TO_DELT[abbrev], nil
+}
+
+// specTerm is a single number and unit within a bin-size specification, such
+// as the "30m" of "1h30m".
+type specTerm struct {
+	// Num is the decimal text of the number, which is 1 if empty.
+	Num     string
+	Letters string
+	Abbrev  string
+	// Folded is set if Letters only matched an abbreviation once lowercased.
+	Folded bool
+}
+
+// The units which a compound spec may be reduced to, from largest to
+// smallest. Calendar units can't be mixed with fixed-width units, since
+// months vary in length.
+var calendarSpecUnits = []string{"Y", "Q", "M"}
+var fixedSpecUnits = []string{"W", "D", "h", "m", "s", "ms", "us", "ns"}
+
+// splitSpec splits a bin-size specification into its multiplier and the
+// canonical abbreviation of its unit. Units are matched case-sensitively
+// first, since "M" (month) and "m" (minute) differ only in case, then
+// case-insensitively so that e.g. "1H" and "1Hour" work.
+func splitSpec(unit string) (int64, string, error) {
+	var terms []specTerm
+	var err error
+	if isISO8601Duration(unit) {
+		terms, err = splitISO8601Duration(unit)
+	} else {
+		terms, err = splitSpecTerms(unit)
+	}
+	if err != nil {
+		return 0, "", err
+	}
+	return combineSpecTerms(unit, terms)
+}
+
+// splitSpecTerms splits a spec such as "1h30m" into its terms, looking up the
+// unit of each.
+func splitSpecTerms(unit string) ([]specTerm, error) {
+	terms := []specTerm{}
+	rs := []rune(strings.TrimSpace(unit))
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
 			continue
 		}
-		unit = abrv
-		break
+		t := specTerm{}
+		for ; i < len(rs) && (unicode.IsNumber(rs[i]) || rs[i] == '.'); i++ {
+			t.Num += string(rs[i])
+		}
+		for ; i < len(rs) && unicode.IsLetter(rs[i]); i++ {
+			t.Letters += string(rs[i])
+		}
+		if t.Num == "" && t.Letters == "" {
+			return nil, fmt.Errorf("unexpected character %q in bin size %q", rs[i], unit)
+		}
+		terms = append(terms, t)
+	}
+	if len(terms) == 0 {
+		terms = append(terms, specTerm{})
 	}
-	jsunit := ABBREV_TO_CHARTJS_UNIT[unit]
-	return unit, jsunit
+	for i, t := range terms {
+		if len(terms) > 1 && t.Letters == "" {
+			return nil, fmt.Errorf("number %q in bin size %q has no unit", t.Num, unit)
+		}
+		abbrev, ok := TIMEDELTA_ABBREVS[t.Letters]
+		if !ok {
+			abbrev, ok = TIMEDELTA_ABBREVS[strings.ToLower(t.Letters)]
+			terms[i].Folded = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("no timedelta configured for abbreviation of %q", t.Letters)
+		}
+		if _, ok := ABBREV_TO_DELT[abbrev]; !ok {
+			return nil, fmt.Errorf("no timedelta configured for frequency of %q leading to abbrev %q", t.Letters, abbrev)
+		}
+		terms[i].Abbrev = abbrev
+	}
+	return terms, nil
 }
 
-func ParseSpec(unit string) (mult int64, delt int64, err error) {
-	rs := []rune(unit)
-	var numbers []rune
-	var letters []rune
-	for _, r := range rs {
-		if unicode.IsNumber(r) {
-			numbers = append(numbers, r)
+func isISO8601Duration(unit string) bool {
+	return len(unit) >= 2 && unit[0] == 'P' && (unicode.IsDigit(rune(unit[1])) || unit[1] == 'T')
+}
+
+// splitISO8601Duration splits an ISO-8601 duration such as "P1DT12H" into its
+// terms. Within the date part "M" means months, while after the "T" it means
+// minutes.
+func splitISO8601Duration(unit string) ([]specTerm, error) {
+	dateUnits := map[byte]string{'Y': "Y", 'M': "M", 'W': "W", 'D': "D"}
+	timeUnits := map[byte]string{'H': "h", 'M': "m", 'S': "s"}
+	terms := []specTerm{}
+	units := dateUnits
+	rest := unit[1:]
+	for rest != "" {
+		if rest[0] == 'T' {
+			if _, ok := units['H']; ok {
+				return nil, fmt.Errorf("ISO-8601 duration %q has more than one 'T'", unit)
+			}
+			if len(rest) == 1 {
+				return nil, fmt.Errorf("ISO-8601 duration %q has no time after the 'T'", unit)
+			}
+			units = timeUnits
+			rest = rest[1:]
+			continue
+		}
+		end := strings.IndexFunc(rest, func(r rune) bool {
+			return !unicode.IsDigit(r) && r != '.' && r != ','
+		})
+		if end <= 0 {
+			return nil, fmt.Errorf("expected a number at %q in ISO-8601 duration %q", rest, unit)
+		}
+		abbrev, ok := units[strings.ToUpper(rest[end : end+1])[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown designator %q in ISO-8601 duration %q", rest[end:end+1], unit)
+		}
+		terms = append(terms, specTerm{Num: strings.Replace(rest[:end], ",", ".", 1), Letters: rest[end : end+1], Abbrev: abbrev})
+		rest = rest[end+1:]
+	}
+	return terms, nil
+}
+
+// combineSpecTerms adds up terms and reduces the total to a whole multiple of
+// a single unit. That unit is the smallest unit in terms if the total is a
+// whole number of it, otherwise the largest smaller unit which is.
+func combineSpecTerms(unit string, terms []specTerm) (int64, string, error) {
+	var hasCalendar, hasFixed, hasFolded bool
+	total := new(big.Rat)
+	smallest := ""
+	for _, t := range terms {
+		v := big.NewRat(1, 1)
+		if t.Num != "" {
+			if _, ok := v.SetString(t.Num); !ok || strings.Count(t.Num, ".") > 1 {
+				return 0, "", fmt.Errorf("invalid number %q in bin size %q", t.Num, unit)
+			}
+		}
+		width := ABBREV_TO_DELT[t.Abbrev]
+		if months, ok := ABBREV_TO_MONTHS[t.Abbrev]; ok {
+			hasCalendar = true
+			width = months
 		} else {
-			letters = append(letters, r)
+			hasFixed = true
+		}
+		hasFolded = hasFolded || t.Folded
+		total.Add(total, v.Mul(v, big.NewRat(width, 1)))
+		// Terms of zero, as in Go's "1h0m0s", don't make the unit smaller.
+		if v.Sign() != 0 && (smallest == "" || ABBREV_TO_DELT[t.Abbrev] < ABBREV_TO_DELT[smallest]) {
+			smallest = t.Abbrev
 		}
 	}
-	if len(numbers) == 0 {
-		mult = 1
-	} else {
-		mult, err = strconv.ParseInt(string(numbers), 10, 64)
-		if err != nil {
-			return 0, 0, err
+	if hasCalendar && hasFixed {
+		msg := fmt.Sprintf("bin size %q mixes calendar units (months, quarters, or years) with fixed-width units, which is ambiguous since months vary in length", unit)
+		if hasFolded && strings.Contains(unit, "M") {
+			msg += "; note that 'M' is months while 'm' is minutes"
 		}
+		return 0, "", fmt.Errorf("%s", msg)
 	}
-	abbrev, ok := TIMEDELTA_ABBREVS[string(letters)]
-	if !ok {
-		return 0, 0, fmt.Errorf("no timedelta configured for abbreviation of %q", string(letters))
+	if total.Sign() <= 0 {
+		return 0, "", fmt.Errorf("bin size %q must be at least 1", unit)
 	}
-	delt, ok = ABBREV_TO_DELT[abbrev]
-	if !ok {
-		return 0, 0, fmt.Errorf("no timedelta configured for frequency of %q leading to abbrev %q", string(letters), abbrev)
+	units := fixedSpecUnits
+	if hasCalendar {
+		units = calendarSpecUnits
+		if !total.IsInt() {
+			return 0, "", fmt.Errorf("bin size %q is not a whole number of months", unit)
+		}
+	} else if !total.IsInt() {
+		return 0, "", fmt.Errorf("bin size %q is not a whole number of nanoseconds", unit)
+	}
+	if !total.Num().IsInt64() {
+		return 0, "", fmt.Errorf("bin size %q is too large", unit)
+	}
+	n := total.Num().Int64()
+	start := 0
+	for i, u := range units {
+		if u == smallest {
+			start = i
+		}
+	}
+	for _, u := range units[start:] {
+		width := ABBREV_TO_DELT[u]
+		if hasCalendar {
+			width = ABBREV_TO_MONTHS[u]
+		}
+		if n%width == 0 {
+			return n / width, u, nil
+		}
+	}
+	// The smallest unit is 1, so this is never reached.
+	return 0, "", fmt.Errorf("bin size %q cannot be reduced to a single unit", unit)
+}
+
+// chartJSTime converts a timestamp in units of precision into epoch_ms,
+// keeping it a whole number when no precision would be lost.
+func chartJSTime(ts, precision int64) interface{} {
+	if precision%TD_1_ms_ns == 0 {
+		return ts * (precision / TD_1_ms_ns)
+	}
+	perMs := TD_1_ms_ns / precision
+	if ts%perMs == 0 {
+		return ts / perMs
 	}
-	return mult, delt, nil
+	return float64(ts) / float64(perMs)
 }
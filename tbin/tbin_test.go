@@ -2,11 +2,30 @@ package tbin
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"sort"
 	"testing"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/stretchr/testify/require"
 )
 
+// ms converts d, a duration in nanoseconds, into milliseconds, which is the
+// default precision of timestamps.
+func ms(d int64) int64 {
+	return d / TD_1_ms_ns
+}
+
+// newAdaptive creates an adaptive Accumulator of timestamps in epoch_ms
+// format, which holds at most about maxBins base bins.
+func newAdaptive(t *testing.T, maxBins int) *Accumulator {
+	acc, err := NewAdaptiveAccumulator(maxBins, BinOptions{})
+	require.NoError(t, err)
+	return acc
+}
+
 func TestParseSpec(t *testing.T) {
 	type tcase struct {
 		Spec    string
@@ -19,37 +38,67 @@ func TestParseSpec(t *testing.T) {
 		{
 			Spec:    "30D",
 			ExpMult: 30,
-			ExpDelt: TD_1_day,
+			ExpDelt: TD_1_day_ns,
 			ExpErr:  nil,
 		},
 		{
 			Spec:    "30m",
 			ExpMult: 30,
-			ExpDelt: TD_1_min,
+			ExpDelt: TD_1_min_ns,
 			ExpErr:  nil,
 		},
 		{
 			Spec:    "5Y",
 			ExpMult: 5,
-			ExpDelt: TD_1_day * 365,
+			ExpDelt: TD_1_year_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1M",
+			ExpMult: 1,
+			ExpDelt: TD_1_month_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "MS",
+			ExpMult: 1,
+			ExpDelt: TD_1_month_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "2Q",
+			ExpMult: 2,
+			ExpDelt: TD_1_quarter_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1H",
+			ExpMult: 1,
+			ExpDelt: TD_1_hr_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "10minutes",
+			ExpMult: 10,
+			ExpDelt: TD_1_min_ns,
 			ExpErr:  nil,
 		},
 		{
 			Spec:    "1W",
 			ExpMult: 1,
-			ExpDelt: TD_1_week,
+			ExpDelt: TD_1_week_ns,
 			ExpErr:  nil,
 		},
 		{
 			Spec:    "m",
 			ExpMult: 1,
-			ExpDelt: TD_1_min,
+			ExpDelt: TD_1_min_ns,
 			ExpErr:  nil,
 		},
 		{
 			Spec:    "1h",
 			ExpMult: 1,
-			ExpDelt: TD_1_hr,
+			ExpDelt: TD_1_hr_ns,
 			ExpErr:  nil,
 		},
 		{
@@ -58,6 +107,186 @@ func TestParseSpec(t *testing.T) {
 			ExpDelt: 0,
 			ExpErr:  fmt.Errorf("no timedelta configured for abbreviation of \"\""),
 		},
+		{
+			Spec:    "1h30m",
+			ExpMult: 90,
+			ExpDelt: TD_1_min_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "2d12h",
+			ExpMult: 60,
+			ExpDelt: TD_1_hr_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1.5h",
+			ExpMult: 90,
+			ExpDelt: TD_1_min_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "2h45m30s",
+			ExpMult: 9930,
+			ExpDelt: TD_1_sec_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1h 15min",
+			ExpMult: 75,
+			ExpDelt: TD_1_min_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1.5s",
+			ExpMult: 1500,
+			ExpDelt: TD_1_ms_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1h0m",
+			ExpMult: 1,
+			ExpDelt: TD_1_hr_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1.5W",
+			ExpMult: 252,
+			ExpDelt: TD_1_hr_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1Y6M",
+			ExpMult: 18,
+			ExpDelt: TD_1_month_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1.5Y",
+			ExpMult: 6,
+			ExpDelt: TD_1_quarter_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "PT90M",
+			ExpMult: 90,
+			ExpDelt: TD_1_min_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "P1DT12H",
+			ExpMult: 36,
+			ExpDelt: TD_1_hr_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "P1Y",
+			ExpMult: 1,
+			ExpDelt: TD_1_year_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "P2W",
+			ExpMult: 2,
+			ExpDelt: TD_1_week_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "PT0,5S",
+			ExpMult: 500,
+			ExpDelt: TD_1_ms_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "100us",
+			ExpMult: 100,
+			ExpDelt: TD_1_us_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "5µs",
+			ExpMult: 5,
+			ExpDelt: TD_1_us_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "250ns",
+			ExpMult: 250,
+			ExpDelt: TD_1_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1.5ms",
+			ExpMult: 1500,
+			ExpDelt: TD_1_us_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1m0.5s",
+			ExpMult: 60500,
+			ExpDelt: TD_1_ms_ns,
+			ExpErr:  nil,
+		},
+		{
+			Spec:    "1H30M",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("bin size \"1H30M\" mixes calendar units (months, quarters, or years) with fixed-width units, which is ambiguous since months vary in length; note that 'M' is months while 'm' is minutes"),
+		},
+		{
+			Spec:    "1M15D",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("bin size \"1M15D\" mixes calendar units (months, quarters, or years) with fixed-width units, which is ambiguous since months vary in length"),
+		},
+		{
+			Spec:    "0.5M",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("bin size \"0.5M\" is not a whole number of months"),
+		},
+		{
+			Spec:    "1.0000000001s",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("bin size \"1.0000000001s\" is not a whole number of nanoseconds"),
+		},
+		{
+			Spec:    "1h30",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("number \"30\" in bin size \"1h30\" has no unit"),
+		},
+		{
+			Spec:    "1..5h",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("invalid number \"1..5\" in bin size \"1..5h\""),
+		},
+		{
+			Spec:    "-1h",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("unexpected character '-' in bin size \"-1h\""),
+		},
+		{
+			Spec:    "0h0m",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("bin size \"0h0m\" must be at least 1"),
+		},
+		{
+			Spec:    "PT",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("ISO-8601 duration \"PT\" has no time after the 'T'"),
+		},
+		{
+			Spec:    "P1H",
+			ExpMult: 0,
+			ExpDelt: 0,
+			ExpErr:  fmt.Errorf("unknown designator \"H\" in ISO-8601 duration \"P1H\""),
+		},
 	} {
 		mult, delt, err := ParseSpec(test.Spec)
 		require.Equal(t, test.ExpErr, err, "for test #%d", idx)
@@ -65,3 +294,940 @@ func TestParseSpec(t *testing.T) {
 		require.Equal(t, test.ExpDelt, delt, "for test #%d", idx)
 	}
 }
+
+func TestBinTimestampCalendar(t *testing.T) {
+	type tcase struct {
+		TS     time.Time
+		Spec   string
+		ExpBin time.Time
+	}
+	utc := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	}
+
+	for idx, test := range []tcase{
+		{time.Date(2024, 2, 29, 23, 59, 59, 0, time.UTC), "1M", utc(2024, 2, 1)},
+		{time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), "M", utc(2024, 3, 1)},
+		{time.Date(2023, 12, 31, 23, 59, 59, 0, time.UTC), "1M", utc(2023, 12, 1)},
+		{time.Date(2023, 5, 15, 12, 0, 0, 0, time.UTC), "1Q", utc(2023, 4, 1)},
+		{time.Date(2023, 5, 15, 12, 0, 0, 0, time.UTC), "2M", utc(2023, 5, 1)},
+		{time.Date(2023, 12, 15, 12, 0, 0, 0, time.UTC), "6M", utc(2023, 7, 1)},
+		// A 365 day year would put the last day of a leap year in the next
+		// year's bin.
+		{time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), "1Y", utc(2024, 1, 1)},
+		{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), "Y", utc(2025, 1, 1)},
+		{time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC), "5Y", utc(2020, 1, 1)},
+		{time.Date(1969, 12, 31, 23, 0, 0, 0, time.UTC), "1M", utc(1969, 12, 1)},
+		// Timestamps are in milliseconds, so centuries before 1970 are fine.
+		{time.Date(1600, 1, 15, 12, 0, 0, 0, time.UTC), "1M", utc(1600, 1, 1)},
+		{time.Date(1600, 2, 29, 12, 0, 0, 0, time.UTC), "1D", utc(1600, 2, 29)},
+	} {
+		bin, err := BinTimestamp(test.TS.UnixMilli(), test.Spec)
+		require.NoError(t, err, "for test #%d", idx)
+		require.Equal(t, test.ExpBin.UnixMilli(), bin, "for test #%d: got %v", idx, time.UnixMilli(bin).UTC())
+	}
+}
+
+func TestBinTimestampsCalendarGaps(t *testing.T) {
+	tss := []int64{
+		time.Date(2024, 1, 15, 0, 0, 0, 0, time.UTC).UnixMilli(),
+		time.Date(2024, 1, 20, 0, 0, 0, 0, time.UTC).UnixMilli(),
+		time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC).UnixMilli(),
+	}
+	bins, err := BinTimestamps(tss, "1M")
+	require.NoError(t, err)
+	require.Equal(t, map[int64]int64{
+		time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli(): 2,
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC).UnixMilli(): 0,
+		time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).UnixMilli(): 0,
+		time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC).UnixMilli(): 1,
+	}, bins)
+}
+
+func TestBinnerLocation(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+
+	type tcase struct {
+		Loc    *time.Location
+		Spec   string
+		TS     time.Time
+		ExpBin time.Time
+	}
+	for idx, test := range []tcase{
+		// Local midnight in LA is 08:00 UTC in winter and 07:00 UTC in summer
+		{la, "1D", time.Date(2023, 1, 15, 7, 59, 0, 0, time.UTC), time.Date(2023, 1, 14, 8, 0, 0, 0, time.UTC)},
+		{la, "1D", time.Date(2023, 1, 15, 8, 0, 0, 0, time.UTC), time.Date(2023, 1, 15, 8, 0, 0, 0, time.UTC)},
+		{la, "1D", time.Date(2023, 7, 15, 6, 0, 0, 0, time.UTC), time.Date(2023, 7, 14, 7, 0, 0, 0, time.UTC)},
+		{la, "1M", time.Date(2023, 8, 1, 6, 0, 0, 0, time.UTC), time.Date(2023, 7, 1, 7, 0, 0, 0, time.UTC)},
+		{la, "1Y", time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC), time.Date(2023, 1, 1, 8, 0, 0, 0, time.UTC)},
+		// Hours in a zone offset by a half hour from UTC start at half past
+		// the UTC hour
+		{kolkata, "1h", time.Date(2023, 1, 15, 10, 45, 0, 0, time.UTC), time.Date(2023, 1, 15, 10, 30, 0, 0, time.UTC)},
+		{kolkata, "1h", time.Date(2023, 1, 15, 10, 15, 0, 0, time.UTC), time.Date(2023, 1, 15, 9, 30, 0, 0, time.UTC)},
+		{kolkata, "1D", time.Date(2023, 1, 15, 18, 29, 0, 0, time.UTC), time.Date(2023, 1, 14, 18, 30, 0, 0, time.UTC)},
+		// Hours on either side of the spring-forward transition in LA
+		{la, "1h", time.Date(2023, 3, 12, 9, 30, 0, 0, time.UTC), time.Date(2023, 3, 12, 9, 0, 0, 0, time.UTC)},
+		{la, "1h", time.Date(2023, 3, 12, 10, 30, 0, 0, time.UTC), time.Date(2023, 3, 12, 10, 0, 0, 0, time.UTC)},
+	} {
+		b, err := NewBinner(test.Spec, BinOptions{Location: test.Loc})
+		require.NoError(t, err, "for test #%d", idx)
+		bin := b.Bin(test.TS.UnixMilli())
+		require.Equal(t, test.ExpBin.UnixMilli(), bin, "for test #%d: got %v", idx, time.UnixMilli(bin).UTC())
+	}
+}
+
+func TestBinnerLocationDSTDays(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	b, err := NewBinner("1D", BinOptions{Location: la})
+	require.NoError(t, err)
+
+	local := func(y int, m time.Month, d, h int) int64 {
+		return time.Date(y, m, d, h, 0, 0, 0, la).UnixMilli()
+	}
+	// Spring forward makes 2023-03-12 23 hours long, and falling back makes
+	// 2023-11-05 25 hours long.
+	for idx, tss := range [][]int64{
+		{local(2023, 3, 11, 12), local(2023, 3, 14, 12)},
+		{local(2023, 11, 4, 12), local(2023, 11, 7, 12)},
+	} {
+		bins := b.BinTimestamps(tss)
+		keys := []int64{}
+		for k := range bins {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		require.Len(t, keys, 4, "for test #%d", idx)
+		widths := []int64{}
+		for i := 1; i < len(keys); i++ {
+			widths = append(widths, (keys[i]-keys[i-1])/TD_1_hr)
+			start := time.UnixMilli(keys[i]).In(la)
+			require.Equal(t, 0, start.Hour(), "for test #%d: bin %v doesn't start at midnight", idx, start)
+		}
+		if idx == 0 {
+			require.Equal(t, []int64{24, 23, 24}, widths)
+		} else {
+			require.Equal(t, []int64{24, 25, 24}, widths)
+		}
+	}
+}
+
+func TestBinnerOriginAndOffset(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	utc := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+	origin := func(t time.Time) *int64 {
+		v := t.UnixMilli()
+		return &v
+	}
+
+	type tcase struct {
+		Spec   string
+		Opts   BinOptions
+		TS     time.Time
+		ExpBin time.Time
+	}
+	for idx, test := range []tcase{
+		{"15m", BinOptions{Offset: 5 * TD_1_min}, utc(2023, 1, 15, 0, 4), utc(2023, 1, 14, 23, 50)},
+		{"15m", BinOptions{Offset: 5 * TD_1_min}, utc(2023, 1, 15, 0, 6), utc(2023, 1, 15, 0, 5)},
+		{"15m", BinOptions{Origin: origin(utc(2023, 1, 1, 0, 5))}, utc(2023, 1, 15, 0, 6), utc(2023, 1, 15, 0, 5)},
+		{"15m", BinOptions{Origin: origin(utc(2023, 1, 1, 0, 5)), Offset: -TD_1_min}, utc(2023, 1, 15, 0, 4), utc(2023, 1, 15, 0, 4)},
+		{"1D", BinOptions{Offset: 6 * TD_1_hr}, utc(2023, 1, 15, 3, 0), utc(2023, 1, 14, 6, 0)},
+		{"1D", BinOptions{Origin: origin(utc(2023, 1, 1, 12, 0))}, utc(2023, 1, 15, 3, 0), utc(2023, 1, 14, 12, 0)},
+		{"1D", BinOptions{Location: la, Offset: 6 * TD_1_hr}, utc(2023, 7, 15, 14, 0), utc(2023, 7, 15, 13, 0)},
+		// 2023-01-18 is a Wednesday
+		{"1W", BinOptions{WeekStart: time.Monday}, utc(2023, 1, 18, 12, 0), utc(2023, 1, 16, 0, 0)},
+		{"1W", BinOptions{WeekStart: time.Sunday}, utc(2023, 1, 18, 12, 0), utc(2023, 1, 15, 0, 0)},
+		{"1W", BinOptions{WeekStart: time.Monday}, utc(2023, 1, 16, 0, 0), utc(2023, 1, 16, 0, 0)},
+		{"1W", BinOptions{WeekStart: time.Monday, Location: la}, utc(2023, 1, 16, 7, 0), utc(2023, 1, 9, 8, 0)},
+		{"2W", BinOptions{Origin: origin(utc(2023, 1, 4, 0, 0))}, utc(2023, 1, 17, 12, 0), utc(2023, 1, 4, 0, 0)},
+		{"1Q", BinOptions{Origin: origin(utc(2023, 2, 1, 0, 0))}, utc(2023, 1, 15, 0, 0), utc(2022, 11, 1, 0, 0)},
+		{"1M", BinOptions{Offset: 6 * TD_1_hr}, utc(2023, 3, 1, 5, 0), utc(2023, 2, 1, 6, 0)},
+		{"1M", BinOptions{Location: la}, utc(2023, 3, 1, 7, 0), utc(2023, 2, 1, 8, 0)},
+	} {
+		b, err := NewBinner(test.Spec, test.Opts)
+		require.NoError(t, err, "for test #%d", idx)
+		bin := b.Bin(test.TS.UnixMilli())
+		require.Equal(t, test.ExpBin.UnixMilli(), bin, "for test #%d: got %v", idx, time.UnixMilli(bin).UTC())
+	}
+}
+
+func TestBinTimestampsWithOrigin(t *testing.T) {
+	origin := time.Date(2023, 1, 15, 0, 5, 0, 0, time.UTC).UnixMilli()
+	b, err := NewBinner("15m", BinOptions{Origin: &origin})
+	require.NoError(t, err)
+	bins := b.BinTimestamps([]int64{origin + 1, origin + 46*TD_1_min})
+	require.Equal(t, map[int64]int64{
+		origin:                 1,
+		origin + 15*TD_1_min:   0,
+		origin + 2*15*TD_1_min: 0,
+		origin + 3*15*TD_1_min: 1,
+	}, bins)
+}
+
+func TestEstimateBinSize(t *testing.T) {
+	type tcase struct {
+		Span       int64
+		TargetBins int
+		// Precision is that of the timestamps, or epoch_ms if zero.
+		Precision int64
+		ExpSpec   string
+		ExpUnit   string
+	}
+	for idx, test := range []tcase{
+		{Span: 2 * TD_1_day_ns, TargetBins: 100, ExpSpec: "30m", ExpUnit: "minute"},
+		{Span: 2 * TD_1_day_ns, TargetBins: 48, ExpSpec: "1h", ExpUnit: "hour"},
+		{Span: TD_1_hr_ns, TargetBins: 60, ExpSpec: "1m", ExpUnit: "minute"},
+		{Span: 10 * TD_1_year_ns, TargetBins: 40, ExpSpec: "3M", ExpUnit: "month"},
+		{Span: 250 * TD_1_ms_ns, TargetBins: 100, ExpSpec: "2ms", ExpUnit: "millisecond"},
+		// Bins can't be finer than the precision of the timestamps.
+		{Span: 10 * TD_1_ms_ns, TargetBins: 100, ExpSpec: "1ms", ExpUnit: "millisecond"},
+		{Span: 0, TargetBins: 100, ExpSpec: "1ms", ExpUnit: "millisecond"},
+		{Span: 10 * TD_1_ms_ns, TargetBins: 100, Precision: TD_1_ns, ExpSpec: "100us", ExpUnit: "millisecond"},
+		{Span: 0, TargetBins: 100, Precision: TD_1_ns, ExpSpec: "1ns", ExpUnit: "millisecond"},
+	} {
+		t.Run(fmt.Sprintf("%d_%d_%d", idx, test.Span, test.TargetBins), func(t *testing.T) {
+			// Unsorted, to check that only the extremes matter.
+			tss := []int64{1000, 1000 + ms(test.Span), 1000 + ms(test.Span)/3}
+			spec, unit := EstimateBinSize(tss, test.TargetBins)
+			if test.Precision != 0 {
+				acc, err := NewAdaptiveAccumulator(0, BinOptions{Precision: test.Precision})
+				require.NoError(t, err)
+				for _, ts := range []int64{1000, 1000 + test.Span/test.Precision} {
+					acc.Add(ts)
+				}
+				spec, unit = acc.EstimateBinSize(test.TargetBins)
+			}
+			require.Equal(t, test.ExpSpec, spec)
+			require.Equal(t, test.ExpUnit, unit)
+		})
+	}
+}
+
+func TestEstimateBinSizeFD(t *testing.T) {
+	// 1000 timestamps one second apart, plus a single outlier a year later
+	// which would stretch bins chosen from the span alone.
+	tss := []int64{}
+	for i := int64(0); i < 1000; i++ {
+		tss = append(tss, i*TD_1_sec)
+	}
+	tss = append(tss, ms(TD_1_year_ns))
+
+	spec, _ := EstimateBinSize(tss, DEFAULT_TARGET_BINS)
+	require.Equal(t, "2D", spec)
+	// IQR is ~500s, so the width is 2*500/cbrt(1001) ~= 100s.
+	spec, unit := EstimateBinSizeFD(tss)
+	require.Equal(t, "2m", spec)
+	require.Equal(t, "minute", unit)
+}
+
+func TestAccumulatorEstimateFinerThanBase(t *testing.T) {
+	// Two days of timestamps one second apart, counted in few enough base
+	// bins that they're widened to 5s.
+	start := time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC).UnixMilli()
+	tss := []int64{}
+	for ts := start; ts <= start+2*TD_1_day; ts += TD_1_sec {
+		tss = append(tss, ts)
+	}
+	acc := newAdaptive(t, 40000)
+	for _, ts := range tss {
+		acc.Add(ts)
+	}
+
+	type tcase struct {
+		TargetBins int
+		FD         bool
+		ExpSpec    string
+	}
+	for idx, test := range []tcase{
+		// 2s bins would be nearest, but the base bins can't be split.
+		{TargetBins: 100000, ExpSpec: "5s"},
+		{TargetBins: 1000000, ExpSpec: "5s"},
+		{TargetBins: 20000, ExpSpec: "10s"},
+		{TargetBins: 100, ExpSpec: "30m"},
+		{FD: true, ExpSpec: "1h"},
+	} {
+		spec, _ := acc.EstimateBinSize(test.TargetBins)
+		if test.FD {
+			spec, _ = acc.EstimateBinSizeFD()
+		}
+		require.Equal(t, test.ExpSpec, spec, "for test #%d", idx)
+		b, err := NewBinner(spec, BinOptions{})
+		require.NoError(t, err)
+		require.Equal(t, b.BinTimestampsSparse(tss), acc.Rebin(b), "for test #%d", idx)
+	}
+}
+
+func TestFormatBinDataForChartJS(t *testing.T) {
+	bins := map[int64]int64{3 * TD_1_hr: 1, TD_1_hr: 4, 2 * TD_1_hr: 0}
+	ctx, err := FormatBinDataForChartJS(bins, "1h")
+	require.NoError(t, err)
+	require.Equal(t, "hour", ctx.Unit)
+	require.Equal(t, "1h", ctx.BinSize)
+	require.Equal(t, []ChartJSDatapoint{
+		{X: int64(3600000), Y: int64(4)}, {X: int64(7200000), Y: int64(0)}, {X: int64(10800000), Y: int64(1)},
+	}, ctx.Datasets[0].Data)
+	require.Equal(t, "count", ctx.Datasets[0].Label)
+
+	// Bins smaller than a millisecond still reach ChartJS in milliseconds.
+	count := Aggregate{Kind: AggCount, Name: "count"}
+	ctx, err = FormatAggregatesForChartJS(map[int64]int64{TD_1_sec_ns + 100*TD_1_us_ns: 2}, nil, []Aggregate{count}, "100us", TD_1_ns, nil)
+	require.NoError(t, err)
+	require.Equal(t, "millisecond", ctx.Unit)
+	require.Equal(t, []ChartJSDatapoint{{X: 1000.1, Y: int64(2)}}, ctx.Datasets[0].Data)
+
+	_, err = FormatBinDataForChartJS(bins, "7x")
+	require.Error(t, err)
+}
+
+func TestFormatAggregatesForChartJS(t *testing.T) {
+	tss := []int64{10 * TD_1_sec, 20 * TD_1_sec, 40 * TD_1_sec, 3*TD_1_min + TD_1_sec}
+	values := []float64{1.5, 1024, 2.5, -2}
+	b, err := NewBinner("1m", BinOptions{})
+	require.NoError(t, err)
+	acc := NewAccumulator(b)
+	acc.TrackValues(true)
+	for i, ts := range tss {
+		acc.AddValue(ts, values[i])
+	}
+	bins := acc.Bins()
+	b.FillGaps(bins)
+
+	aggs := []Aggregate{}
+	for _, name := range []string{"count", "sum", "max", "p50"} {
+		agg, err := ParseAggregate(name)
+		require.NoError(t, err)
+		aggs = append(aggs, agg)
+	}
+	ctx, err := FormatAggregatesForChartJS(bins, acc.Values(), aggs, "1m", acc.Precision(), nil)
+	require.NoError(t, err)
+	require.Len(t, ctx.Datasets, 4)
+	ys := map[string][]interface{}{}
+	for i, ds := range ctx.Datasets {
+		require.Equal(t, aggs[i].Name, ds.Aggregate)
+		for _, p := range ds.Data {
+			ys[ds.Aggregate] = append(ys[ds.Aggregate], p.Y)
+		}
+	}
+	require.Equal(t, []interface{}{int64(3), int64(0), int64(0), int64(1)}, ys["count"])
+	require.Equal(t, []interface{}{1028.0, 0.0, 0.0, -2.0}, ys["sum"])
+	// Bins without values have no max or median.
+	require.Equal(t, []interface{}{1024.0, nil, nil, -2.0}, ys["max"])
+	require.Equal(t, []interface{}{2.5, nil, nil, -2.0}, ys["p50"])
+
+	_, err = FormatAggregatesForChartJS(bins, nil, aggs, "1m", acc.Precision(), nil)
+	require.Error(t, err)
+}
+
+func TestBinTimestampsSubMillisecond(t *testing.T) {
+	// Microsecond resolution tracing data, all within the same millisecond.
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+	tss := []int64{base + 5*TD_1_us_ns, base + 99*TD_1_us_ns, base + 100*TD_1_us_ns, base + 350*TD_1_us_ns, base + 351*TD_1_us_ns}
+	b, err := NewBinner("100us", BinOptions{Precision: TD_1_ns})
+	require.NoError(t, err)
+	require.Equal(t, map[int64]int64{
+		base:                  2,
+		base + 100*TD_1_us_ns: 1,
+		base + 200*TD_1_us_ns: 0,
+		base + 300*TD_1_us_ns: 2,
+	}, b.BinTimestamps(tss))
+
+	b, err = NewBinner("1us", BinOptions{Precision: TD_1_ns})
+	require.NoError(t, err)
+	require.Equal(t, base+TD_1_us_ns, b.Bin(base+1234))
+
+	// Timestamps in milliseconds can't be split into finer bins.
+	_, err = BinTimestamps([]int64{base / TD_1_ms_ns}, "100us")
+	require.Error(t, err)
+	_, err = NewBinner("1h", BinOptions{Precision: 7})
+	require.Error(t, err)
+}
+
+func TestBinTimestampBeforeEpoch(t *testing.T) {
+	utc := func(y int, m time.Month, d, h, min int) time.Time {
+		return time.Date(y, m, d, h, min, 0, 0, time.UTC)
+	}
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	type tcase struct {
+		Spec   string
+		Opts   BinOptions
+		TS     time.Time
+		ExpBin time.Time
+	}
+	for idx, test := range []tcase{
+		{"1h", BinOptions{}, time.UnixMilli(-1), utc(1969, 12, 31, 23, 0)},
+		{"1h", BinOptions{}, utc(1969, 12, 31, 23, 0), utc(1969, 12, 31, 23, 0)},
+		{"7m", BinOptions{}, utc(1969, 12, 31, 23, 55), utc(1969, 12, 31, 23, 53)},
+		{"1D", BinOptions{}, utc(1969, 12, 31, 12, 0), utc(1969, 12, 31, 0, 0)},
+		{"1D", BinOptions{}, utc(1900, 6, 15, 12, 0), utc(1900, 6, 15, 0, 0)},
+		{"1W", BinOptions{WeekStart: time.Monday}, utc(1969, 12, 31, 12, 0), utc(1969, 12, 29, 0, 0)},
+		{"1M", BinOptions{}, utc(1969, 12, 31, 12, 0), utc(1969, 12, 1, 0, 0)},
+		{"1Q", BinOptions{}, utc(1969, 11, 30, 0, 0), utc(1969, 10, 1, 0, 0)},
+		{"10Y", BinOptions{}, utc(1955, 1, 1, 0, 0), utc(1950, 1, 1, 0, 0)},
+		{"1D", BinOptions{Location: la}, utc(1970, 1, 1, 3, 0), time.Date(1969, 12, 31, 0, 0, 0, 0, la)},
+		{"1h", BinOptions{Offset: 30 * TD_1_min}, utc(1970, 1, 1, 0, 10), utc(1969, 12, 31, 23, 30)},
+		{"1D", BinOptions{}, utc(1600, 1, 1, 12, 0), utc(1600, 1, 1, 0, 0)},
+		{"1W", BinOptions{WeekStart: time.Monday}, utc(1600, 1, 1, 12, 0), utc(1599, 12, 27, 0, 0)},
+		{"1h", BinOptions{Location: la}, utc(1600, 1, 1, 12, 30), time.Date(1600, 1, 1, 4, 0, 0, 0, la)},
+	} {
+		b, err := NewBinner(test.Spec, test.Opts)
+		require.NoError(t, err)
+		bin := b.Bin(test.TS.UnixMilli())
+		require.Equal(t, test.ExpBin.UnixMilli(), bin, "for test #%d: got %v", idx, time.UnixMilli(bin).UTC())
+	}
+}
+
+func TestFromTime(t *testing.T) {
+	old := time.Date(1600, 1, 1, 12, 0, 0, 1500, time.UTC)
+	ts, err := FromTime(old, TD_1_ms_ns)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(1600, 1, 1, 12, 0, 0, 0, time.UTC), ToTime(ts, TD_1_ms_ns))
+	ts, err = FromTime(old, TD_1_us_ns)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(1600, 1, 1, 12, 0, 0, 1000, time.UTC), ToTime(ts, TD_1_us_ns))
+	// Nanoseconds can only hold times from 1677 to 2262.
+	_, err = FromTime(old, TD_1_ns)
+	require.Error(t, err)
+
+	recent := time.Date(2024, 3, 1, 12, 0, 0, 1500, time.UTC)
+	ts, err = FromTime(recent, TD_1_ns)
+	require.NoError(t, err)
+	require.Equal(t, recent.UnixNano(), ts)
+	require.Equal(t, recent, ToTime(ts, TD_1_ns))
+	_, err = FromTime(ToTime(math.MaxInt64, TD_1_ns).Add(1), TD_1_ns)
+	require.Error(t, err)
+}
+
+func TestBinTimestampsStraddlingEpoch(t *testing.T) {
+	tss := []int64{-90 * TD_1_min, -1, 0, 30 * TD_1_min, 150 * TD_1_min}
+	bins, err := BinTimestamps(tss, "1h")
+	require.NoError(t, err)
+	require.Equal(t, map[int64]int64{
+		-2 * TD_1_hr: 1,
+		-1 * TD_1_hr: 1,
+		0:            2,
+		TD_1_hr:      0,
+		2 * TD_1_hr:  1,
+	}, bins)
+}
+
+func TestBinTimestampsExtremes(t *testing.T) {
+	// The first bin starts before the earliest time that can be held in an
+	// int64, so it's clamped, while the last bin ends after the latest.
+	// Nanoseconds are used, since there'd be too many bins to fill in
+	// between the extremes of milliseconds.
+	tss := []int64{math.MinInt64, math.MinInt64 + TD_1_hr_ns, math.MaxInt64 - TD_1_hr_ns, math.MaxInt64}
+	for _, spec := range []string{"1D", "1M", "100Y"} {
+		b, err := NewBinner(spec, BinOptions{Precision: TD_1_ns})
+		require.NoError(t, err, spec)
+		require.Equal(t, int64(math.MinInt64), b.Bin(math.MinInt64), spec)
+		bins := b.BinTimestamps(tss)
+		keys := []int64{}
+		var total int64
+		for k, v := range bins {
+			keys = append(keys, k)
+			total += v
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		require.Equal(t, int64(len(tss)), total, spec)
+		require.Equal(t, int64(math.MinInt64), keys[0], spec)
+		require.Equal(t, b.Bin(math.MaxInt64), keys[len(keys)-1], spec)
+		for i := 1; i < len(keys); i++ {
+			require.Equal(t, keys[i], b.Next(keys[i-1]), spec)
+		}
+	}
+
+	bin, err := BinTimestamp(math.MinInt64+1, "1h")
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MinInt64), bin)
+	bin, err = BinTimestamp(math.MaxInt64, "1h")
+	require.NoError(t, err)
+	require.Equal(t, int64(math.MaxInt64)-int64(math.MaxInt64)%TD_1_hr, bin)
+	for _, spec := range []string{"1D", "1M", "100Y"} {
+		b, err := NewBinner(spec, BinOptions{})
+		require.NoError(t, err, spec)
+		require.Equal(t, int64(math.MinInt64), b.Bin(math.MinInt64), spec)
+		// The bin after the last is clamped rather than wrapping around.
+		require.GreaterOrEqual(t, b.Next(b.Bin(math.MaxInt64)), b.Bin(math.MaxInt64), spec)
+	}
+
+	_, err = NewBinner("1000Y", BinOptions{})
+	require.Error(t, err)
+}
+
+func TestBinTimestampsSparse(t *testing.T) {
+	// A stray timestamp from 1970 alongside a day of data in 2024.
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	min := TD_1_min
+	tss := []int64{5 * TD_1_sec, day + 10*TD_1_sec, day + 10*TD_1_sec, day + 3*min}
+	b, err := NewBinner("1m", BinOptions{})
+	require.NoError(t, err)
+	require.Equal(t, (day+3*min)/min+1, b.CountBins(tss[0], tss[len(tss)-1]))
+
+	bins := b.BinTimestampsSparse(tss)
+	require.Equal(t, map[int64]int64{0: 1, day: 2, day + 3*min: 1}, bins)
+	gaps := b.Gaps(bins)
+	require.Equal(t, []Gap{
+		{Start: min, End: day, Bins: day/min - 1},
+		{Start: day + min, End: day + 3*min, Bins: 2},
+	}, gaps)
+
+	ctx, err := FormatSparseBinDataForChartJS(bins, "1m", gaps)
+	require.NoError(t, err)
+	require.Equal(t, []ChartJSDatapoint{
+		{X: int64(0), Y: int64(1)},
+		{X: int64(60000), Gap: &ChartJSGap{End: day, Bins: day/min - 1}},
+		{X: day, Y: int64(2)},
+		{X: day + 60000, Gap: &ChartJSGap{End: day + 180000, Bins: 2}},
+		{X: day + 180000, Y: int64(1)},
+	}, ctx.Datasets[0].Data)
+}
+
+func TestCountBins(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	type tcase struct {
+		Spec        string
+		Opts        BinOptions
+		First, Last time.Time
+		Exp         int64
+	}
+	for idx, test := range []tcase{
+		{"1h", BinOptions{}, time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC), time.Date(2024, 1, 1, 5, 10, 0, 0, time.UTC), 6},
+		{"1h", BinOptions{}, time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 40, 0, 0, time.UTC), 1},
+		{"1Q", BinOptions{}, time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), 5},
+		// March 10th is only 23 hours long in Los Angeles.
+		{"1D", BinOptions{Location: la}, time.Date(2024, 3, 1, 12, 0, 0, 0, la), time.Date(2024, 3, 31, 12, 0, 0, 0, la), 31},
+		{"1ns", BinOptions{Precision: TD_1_ns}, time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64), math.MaxInt64},
+		{"1ms", BinOptions{}, ToTime(math.MinInt64, TD_1_ms_ns), ToTime(math.MaxInt64, TD_1_ms_ns), math.MaxInt64},
+	} {
+		b, err := NewBinner(test.Spec, test.Opts)
+		require.NoError(t, err)
+		first, err := FromTime(test.First, b.Precision())
+		require.NoError(t, err)
+		last, err := FromTime(test.Last, b.Precision())
+		require.NoError(t, err)
+		require.Equal(t, test.Exp, b.CountBins(first, last), "for test #%d", idx)
+	}
+}
+
+func TestClipPercentile(t *testing.T) {
+	tss := []int64{}
+	for i := int64(1); i <= 1000; i++ {
+		tss = append(tss, i*TD_1_sec_ns)
+	}
+	// Outliers at both ends, out of order.
+	tss = append([]int64{-TD_1_year_ns}, tss...)
+	tss = append(tss, 50*TD_1_year_ns)
+
+	kept, lo, hi, err := ClipPercentile(tss, 0.5)
+	require.NoError(t, err)
+	require.Equal(t, 5*TD_1_sec_ns, lo)
+	require.Equal(t, 996*TD_1_sec_ns, hi)
+	require.Len(t, kept, 992)
+	require.Equal(t, lo, kept[0])
+
+	kept, _, _, err = ClipPercentile(tss, 0)
+	require.NoError(t, err)
+	require.Equal(t, tss, kept)
+
+	_, _, _, err = ClipPercentile(tss, 50)
+	require.Error(t, err)
+}
+
+func TestAccumulator(t *testing.T) {
+	start := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+	tss, err := GenRandomTimestamps(20000, 7, start, start+3*TD_1_day, "normal")
+	require.NoError(t, err)
+	// A few timestamps before 1970 and far from the rest.
+	tss = append(tss, -TD_1_day-1, -(TD_1_day + TD_1_hr))
+	weights := []float64{}
+	for i := range tss {
+		weights = append(weights, float64(i%7))
+	}
+	// Key i%10 gets 10-i%10 of every 55 timestamps, so the keys are ranked
+	// "k0", "k1", ... by size.
+	keys := []string{}
+	for k := 0; k < 10; k++ {
+		for j := 0; j < 10-k; j++ {
+			keys = append(keys, fmt.Sprintf("k%d", k))
+		}
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	require.NoError(t, err)
+	la, err := time.LoadLocation("America/Los_Angeles")
+	require.NoError(t, err)
+	origin := func(t time.Time) *int64 {
+		v := t.UnixMilli()
+		return &v
+	}
+	startOrigin := time.UnixMilli(start).Add(7 * time.Minute)
+
+	type tcase struct {
+		Spec string
+		Opts BinOptions
+		// MaxBins is the number of base bins of the adaptive Accumulator,
+		// unless Exact is set and it keeps every timestamp.
+		MaxBins int
+		Exact   bool
+	}
+	for idx, test := range []tcase{
+		{Spec: "1h", Opts: BinOptions{}, MaxBins: 100},
+		{Spec: "15m", Opts: BinOptions{}, MaxBins: 1000},
+		{Spec: "1D", Opts: BinOptions{}, MaxBins: 1000},
+		{Spec: "1W", Opts: BinOptions{WeekStart: time.Monday}, MaxBins: 1000},
+		// Base bins are widened to 3h, which must still line up with the
+		// days and weeks of a zone that's a half hour off from UTC.
+		{Spec: "1D", Opts: BinOptions{Location: kolkata}, MaxBins: 20},
+		{Spec: "2W", Opts: BinOptions{Location: kolkata}, MaxBins: 20},
+		{Spec: "1h", Opts: BinOptions{Location: kolkata}, MaxBins: 1000},
+		{Spec: "1D", Opts: BinOptions{Location: la}, MaxBins: 20},
+		{Spec: "1M", Opts: BinOptions{Location: la}, MaxBins: 20},
+		{Spec: "1D", Opts: BinOptions{Offset: 90 * TD_1_min}, MaxBins: 20},
+		{Spec: "1h", Opts: BinOptions{Location: kolkata, Offset: -7 * TD_1_sec}, MaxBins: 1000},
+		// Base bins aren't widened past the origin's alignment.
+		{Spec: "1h", Opts: BinOptions{Origin: origin(startOrigin)}, MaxBins: 20},
+		{Spec: "1D", Opts: BinOptions{Origin: origin(startOrigin), Location: kolkata}, MaxBins: 20},
+		{Spec: "1h", Opts: BinOptions{Origin: origin(startOrigin.Add(time.Millisecond))}, MaxBins: 20},
+		{Spec: "1h", Opts: BinOptions{Origin: origin(startOrigin.Add(time.Millisecond))}, Exact: true},
+		{Spec: "1D", Opts: BinOptions{Origin: origin(startOrigin), Location: la, Offset: TD_1_hr}, Exact: true},
+	} {
+		t.Run(fmt.Sprintf("%d_%s", idx, test.Spec), func(t *testing.T) {
+			b, err := NewBinner(test.Spec, test.Opts)
+			require.NoError(t, err)
+			exp := b.BinTimestampsSparse(tss)
+			expSums := map[int64]float64{}
+			for i, ts := range tss {
+				if weights[i] != 0 {
+					expSums[b.Bin(ts)] += weights[i]
+				}
+			}
+
+			adaptive, err := NewAdaptiveAccumulator(test.MaxBins, test.Opts)
+			if test.Exact {
+				adaptive, err = NewExactAccumulator(0)
+			}
+			require.NoError(t, err)
+			for _, acc := range []*Accumulator{NewAccumulator(b), adaptive} {
+				acc.TrackValues(false)
+				acc.TrackGroups()
+				whole := acc.Fork()
+				// Split the timestamps unevenly so that the forks of an
+				// adaptive accumulator end up with bins of different widths.
+				forks := []*Accumulator{acc.Fork(), acc.Fork(), acc.Fork()}
+				for i, ts := range tss {
+					key := keys[i%len(keys)]
+					whole.AddGrouped(key, ts, weights[i])
+					if i < 10 {
+						acc.AddGrouped(key, ts, weights[i])
+					} else {
+						forks[i%3].AddGrouped(key, ts, weights[i])
+					}
+				}
+				for _, fork := range forks {
+					acc.Merge(fork)
+				}
+				// Merging base bins into fewer, wider ones still lands every
+				// timestamp in the same bin.
+				require.Equal(t, exp, acc.Rebin(b))
+				require.Equal(t, exp, whole.Rebin(b))
+				require.Equal(t, int64(len(tss)), acc.Count())
+				require.Equal(t, -(TD_1_day + TD_1_hr), acc.Min())
+				require.Equal(t, whole.Max(), acc.Max())
+				if acc == adaptive && !test.Exact && test.Opts.Origin == nil {
+					require.LessOrEqual(t, len(acc.Bins()), test.MaxBins+1)
+				}
+
+				sums := map[int64]float64{}
+				for k, v := range acc.RebinValues(b) {
+					if v.Sum != 0 {
+						sums[k] = v.Sum
+					}
+				}
+				require.Equal(t, expSums, sums)
+
+				groups := acc.TopGroups(3)
+				require.Len(t, groups, 4)
+				require.Equal(t, []string{"k0", "k1", "k2", ""}, []string{groups[0].Key, groups[1].Key, groups[2].Key, groups[3].Key})
+				require.True(t, groups[3].Other)
+				// Together the groups are every timestamp, in the same bins.
+				total := map[int64]int64{}
+				for _, g := range groups {
+					for k, v := range g.Acc.Rebin(b) {
+						total[k] += v
+					}
+				}
+				require.Equal(t, exp, total)
+				require.Len(t, acc.TopGroups(0), 10)
+			}
+		})
+	}
+}
+
+func TestAccumulatorGroupLimit(t *testing.T) {
+	b, err := NewBinner("1h", BinOptions{})
+	require.NoError(t, err)
+	require.Nil(t, NewAccumulator(b).Values())
+	require.Nil(t, NewAccumulator(b).TopGroups(3))
+
+	// Keys beyond MAX_GROUP_KEYS are only counted as others.
+	acc := NewAccumulator(b)
+	acc.TrackGroups()
+	for i := 0; i <= MAX_GROUP_KEYS; i++ {
+		acc.AddGrouped(fmt.Sprint(i), int64(i), 1)
+	}
+	groups := acc.TopGroups(0)
+	require.Len(t, groups, MAX_GROUP_KEYS+1)
+	require.True(t, groups[MAX_GROUP_KEYS].Other)
+	require.Equal(t, int64(1), groups[MAX_GROUP_KEYS].Acc.Count())
+}
+
+func TestAccumulatorChanges(t *testing.T) {
+	b, err := NewBinner("1m", BinOptions{})
+	require.NoError(t, err)
+	acc := NewAccumulator(b)
+	acc.Add(10 * TD_1_sec)
+	acc.TrackChanges()
+	require.Equal(t, map[int64]int64{}, acc.Changes())
+
+	acc.Add(20 * TD_1_sec)
+	acc.Add(5 * TD_1_min)
+	acc.Add(5*TD_1_min + TD_1_sec)
+	require.Equal(t, map[int64]int64{0: 2, 5 * TD_1_min: 2}, acc.Changes())
+	require.Equal(t, map[int64]int64{}, acc.Changes())
+
+	acc.Add(TD_1_sec)
+	require.Equal(t, map[int64]int64{0: 3}, acc.Changes())
+}
+
+func TestAccumulatorClipGroups(t *testing.T) {
+	acc := newAdaptive(t, 1000)
+	acc.TrackGroups()
+	for i := int64(0); i < 100; i++ {
+		acc.AddGrouped(fmt.Sprint(i%2), i*TD_1_min, 1)
+	}
+	dropped, _, _, err := acc.ClipPercentile(10)
+	require.NoError(t, err)
+	var count int64
+	for _, g := range acc.TopGroups(0) {
+		count += g.Acc.Count()
+	}
+	require.Equal(t, int64(100)-dropped, count)
+	require.Equal(t, acc.Count(), count)
+}
+
+func TestAccumulatorEstimates(t *testing.T) {
+	tss := []int64{}
+	for i := int64(0); i < 1000; i++ {
+		tss = append(tss, i*TD_1_sec)
+	}
+	tss = append(tss, ms(TD_1_year_ns))
+	acc := newAdaptive(t, 0)
+	for _, ts := range tss {
+		acc.Add(ts)
+	}
+	spec, _ := acc.EstimateBinSize(DEFAULT_TARGET_BINS)
+	expSpec, _ := EstimateBinSize(tss, DEFAULT_TARGET_BINS)
+	require.Equal(t, expSpec, spec)
+	spec, _ = acc.EstimateBinSizeFD()
+	expSpec, _ = EstimateBinSizeFD(tss)
+	require.Equal(t, expSpec, spec)
+
+	dropped, lo, hi, err := acc.ClipPercentile(0.1)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), dropped)
+	require.Equal(t, TD_1_sec, lo)
+	require.Equal(t, 999*TD_1_sec, hi)
+	require.Equal(t, int64(999), acc.Count())
+}
+
+func TestParseAggregate(t *testing.T) {
+	cases := []struct {
+		in   string
+		kind AggregateKind
+		q    float64
+		name string
+	}{
+		{"count", AggCount, 0, "count"},
+		{"SUM", AggSum, 0, "sum"},
+		{"min", AggMin, 0, "min"},
+		{"max", AggMax, 0, "max"},
+		{"avg", AggMean, 0, "mean"},
+		{"p95", AggQuantile, 0.95, "p95"},
+		{"p99.9", AggQuantile, 0.999, "p99.9"},
+		{"p0", AggQuantile, 0, "p0"},
+	}
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			agg, err := ParseAggregate(c.in)
+			require.NoError(t, err)
+			require.Equal(t, c.kind, agg.Kind)
+			require.InDelta(t, c.q, agg.Q, 1e-12)
+			require.Equal(t, c.name, agg.Name)
+		})
+	}
+	for _, bad := range []string{"", "median", "p", "p101", "p-1", "pfoo"} {
+		_, err := ParseAggregate(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestQuantileSketch(t *testing.T) {
+	// Few enough values are kept, giving exact quantiles.
+	s := &QuantileSketch{}
+	for _, x := range []float64{5, 1, 4, 2, 3} {
+		s.Add(x)
+	}
+	require.Equal(t, 1.0, s.Quantile(0))
+	require.Equal(t, 3.0, s.Quantile(0.5))
+	require.Equal(t, 4.5, s.Quantile(0.875))
+	require.Equal(t, 5.0, s.Quantile(1))
+	require.True(t, math.IsNaN((&QuantileSketch{}).Quantile(0.5)))
+
+	// Beyond that, quantiles are estimated within the relative accuracy,
+	// whether the values are added to one sketch or spread across several.
+	xs := []float64{}
+	for i := 0; i < 10000; i++ {
+		xs = append(xs, math.Exp(float64(i%997)/50)-float64(i%3))
+	}
+	whole := &QuantileSketch{}
+	parts := []*QuantileSketch{{}, {}, {}}
+	for i, x := range xs {
+		whole.Add(x)
+		parts[i%3].Add(x)
+	}
+	merged := &QuantileSketch{}
+	for _, p := range parts {
+		merged.Merge(p)
+	}
+	sorted := append([]float64{}, xs...)
+	sort.Float64s(sorted)
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 1} {
+		exp := sorted[int(math.Round(q*float64(len(sorted)-1)))]
+		for _, s := range []*QuantileSketch{whole, merged} {
+			require.InDelta(t, exp, s.Quantile(q), math.Abs(exp)*SKETCH_RELATIVE_ACCURACY+1e-9, "q=%v", q)
+		}
+	}
+}
+
+func TestBinValues(t *testing.T) {
+	agg := func(name string) Aggregate {
+		a, err := ParseAggregate(name)
+		require.NoError(t, err)
+		return a
+	}
+	a, b := NewBinValues(true), NewBinValues(true)
+	for _, x := range []float64{3, -1, 10} {
+		a.Add(x)
+	}
+	b.Add(6)
+	a.Merge(b)
+	a.Merge(NewBinValues(true))
+	for name, exp := range map[string]float64{"count": 4, "sum": 18, "min": -1, "max": 10, "mean": 4.5, "p50": 4.5, "p100": 10} {
+		got, ok := a.Aggregate(agg(name))
+		require.True(t, ok, name)
+		require.Equal(t, exp, got, name)
+	}
+
+	empty := NewBinValues(true)
+	sum, ok := empty.Aggregate(agg("sum"))
+	require.True(t, ok)
+	require.Equal(t, 0.0, sum)
+	for _, name := range []string{"min", "max", "mean", "p50"} {
+		_, ok := empty.Aggregate(agg(name))
+		require.False(t, ok, name)
+	}
+
+	// Without a sketch there are no quantiles.
+	plain := NewBinValues(false)
+	plain.Add(1)
+	_, ok = plain.Aggregate(agg("p50"))
+	require.False(t, ok)
+}
+
+func TestBinIntervals(t *testing.T) {
+	s := TD_1_sec
+	starts := []int64{0, 30 * s, 60 * s, 200 * s, 300 * s, 600 * s, 660 * s}
+	ends := []int64{90 * s, 60 * s, 120 * s, 200 * s, 490 * s, 660 * s, 720 * s}
+	ib, err := BinIntervals(starts, ends, "1m")
+	require.NoError(t, err)
+	m := TD_1_min
+	// The interval ending at 60s isn't active in the bin starting then, and
+	// the back-to-back intervals at 600s and 660s never overlap.
+	require.Equal(t, map[int64]int64{0: 2, m: 2, 3 * m: 1, 5 * m: 1, 6 * m: 1, 7 * m: 1, 8 * m: 1, 10 * m: 1, 11 * m: 1}, ib.Active)
+	require.Equal(t, map[int64]int64{0: 2, m: 2, 3 * m: 1, 5 * m: 1, 6 * m: 1, 7 * m: 1, 8 * m: 1, 10 * m: 1, 11 * m: 1}, ib.Peak)
+
+	_, err = BinIntervals([]int64{0}, []int64{}, "1m")
+	require.Error(t, err)
+	_, err = BinIntervals([]int64{10}, []int64{5}, "1m")
+	require.Error(t, err)
+}
+
+func TestBinIntervalsBruteForce(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	starts, ends := []int64{}, []int64{}
+	for i := 0; i < 500; i++ {
+		start := rng.Int63n(2 * TD_1_hr)
+		starts = append(starts, start)
+		ends = append(ends, start+rng.Int63n(10*TD_1_min))
+	}
+	b, err := NewBinner("1m", BinOptions{})
+	require.NoError(t, err)
+	expActive, expPeak := map[int64]int64{}, map[int64]int64{}
+	for k := int64(0); k < 3*TD_1_hr; k += TD_1_min {
+		// Concurrency can only peak at the start of the bin or at the start
+		// of an interval within it.
+		moments := []int64{k}
+		for i := range starts {
+			end := ends[i]
+			if end == starts[i] {
+				end += 1
+			}
+			if starts[i] < k+TD_1_min && end > k {
+				expActive[k] += 1
+			}
+			if starts[i] >= k && starts[i] < k+TD_1_min {
+				moments = append(moments, starts[i])
+			}
+		}
+		for _, at := range moments {
+			var n int64
+			for i := range starts {
+				if starts[i] <= at && (at < ends[i] || at == starts[i] && ends[i] == starts[i]) {
+					n += 1
+				}
+			}
+			if n > expPeak[k] {
+				expPeak[k] = n
+			}
+		}
+		if expActive[k] == 0 {
+			delete(expActive, k)
+			delete(expPeak, k)
+		}
+	}
+
+	// Intervals added to forks of an Accumulator come out the same.
+	acc := newAdaptive(t, 1000)
+	acc.TrackIntervals()
+	forks := []*Accumulator{acc.Fork(), acc.Fork()}
+	for i := range starts {
+		forks[i%2].AddInterval(starts[i], ends[i])
+	}
+	for _, fork := range forks {
+		acc.Merge(fork)
+	}
+	ib, err := acc.BinIntervals(b)
+	require.NoError(t, err)
+	require.Equal(t, expActive, ib.Active)
+	require.Equal(t, expPeak, ib.Peak)
+
+	_, err = NewAccumulator(b).BinIntervals(b)
+	require.Error(t, err)
+}
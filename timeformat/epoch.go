@@ -0,0 +1,165 @@
+package timeformat
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseEpochUnit turns the name of a unit of epoch timestamps ("s", "ms",
+// "us", or "ns") into the duration of one tick of that unit.
+func ParseEpochUnit(name string) (time.Duration, error) {
+	switch strings.ToLower(name) {
+	case "s", "sec", "seconds":
+		return time.Second, nil
+	case "ms", "millis", "milliseconds":
+		return time.Millisecond, nil
+	case "us", "µs", "micros", "microseconds":
+		return time.Microsecond, nil
+	case "ns", "nanos", "nanoseconds":
+		return time.Nanosecond, nil
+	}
+	return 0, fmt.Errorf("unknown epoch unit %q, must be one of s, ms, us, or ns", name)
+}
+
+// ParseDuration parses a duration which is either a number of ticks of unit,
+// e.g. "1500" or "1.5" when unit is time.Second, or has a unit of its own as
+// accepted by time.ParseDuration, e.g. "1.5s" or "250ms".
+func ParseDuration(s string, unit time.Duration) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	t, err := parseEpoch(s, unit)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, must be a number of %s or have a unit such as \"1.5s\"", s, EpochUnitName(unit))
+	}
+	return time.Duration(t.UnixNano()), nil
+}
+
+// EpochUnitName is the inverse of ParseEpochUnit.
+func EpochUnitName(unit time.Duration) string {
+	switch unit {
+	case time.Second:
+		return "s"
+	case time.Millisecond:
+		return "ms"
+	case time.Microsecond:
+		return "us"
+	case time.Nanosecond:
+		return "ns"
+	}
+	return unit.String()
+}
+
+// GuessEpochUnit infers the unit of epoch timestamps from their magnitude.
+// Timestamps from the last few decades have 10 digits as seconds, 13 as
+// milliseconds, 16 as microseconds, and 19 as nanoseconds, so the median
+// number of digits in the integer part of the samples picks the unit. Samples
+// which aren't numbers are ignored.
+func GuessEpochUnit(samples []string) (time.Duration, error) {
+	digits := []int{}
+	for _, s := range samples {
+		if _, _, err := splitEpoch(s); err != nil {
+			continue
+		}
+		ipart := strings.TrimLeft(s, "+-")
+		if dot := strings.Index(ipart, "."); dot >= 0 {
+			ipart = ipart[:dot]
+		}
+		digits = append(digits, len(strings.TrimLeft(ipart, "0")))
+	}
+	if len(digits) == 0 {
+		return 0, fmt.Errorf("cannot guess the unit of epoch timestamps since none of the %d samples are numbers", len(samples))
+	}
+	sort.Ints(digits)
+	median := digits[len(digits)/2]
+	switch {
+	case median <= 11:
+		return time.Second, nil
+	case median <= 14:
+		return time.Millisecond, nil
+	case median <= 17:
+		return time.Microsecond, nil
+	}
+	return time.Nanosecond, nil
+}
+
+// MakeParseEpoch returns a ParseFunc for timestamps which are a count of unit
+// since the UNIX epoch. A fractional part is allowed (e.g.
+// `1699999999.123456` seconds) and is kept to nanosecond precision.
+func MakeParseEpoch(unit time.Duration) ParseFunc {
+	return func(s string) (time.Time, error) {
+		return parseEpoch(s, unit)
+	}
+}
+
+// MakeFmtEpoch is the opposite of MakeParseEpoch, though it always formats
+// whole numbers of unit.
+func MakeFmtEpoch(unit time.Duration) FmtFunc {
+	return func(t time.Time) (string, error) {
+		per := int64(time.Second / unit)
+		return fmt.Sprintf("%d", t.Unix()*per+int64(t.Nanosecond())/int64(unit)), nil
+	}
+}
+
+// splitEpoch splits a decimal number into its integer part and the digits
+// of its fractional part, validating both.
+func splitEpoch(s string) (int64, string, error) {
+	ipart, frac := s, ""
+	if dot := strings.Index(s, "."); dot >= 0 {
+		ipart, frac = s[:dot], s[dot+1:]
+	}
+	for _, r := range frac {
+		if r < '0' || r > '9' {
+			return 0, "", fmt.Errorf("invalid fractional part in epoch timestamp %q", s)
+		}
+	}
+	if ipart == "" || ipart == "-" || ipart == "+" {
+		ipart += "0"
+		if frac == "" {
+			return 0, "", fmt.Errorf("epoch timestamp %q has no digits", s)
+		}
+	}
+	i, err := strconv.ParseInt(ipart, 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	return i, frac, nil
+}
+
+func parseEpoch(s string, unit time.Duration) (time.Time, error) {
+	if strings.ContainsAny(s, "eE") {
+		// Exponent notation, as some JSON encoders produce for large
+		// numbers, can't be split into digits, so accept float precision.
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		sec := f * float64(unit) / float64(time.Second)
+		whole := int64(sec)
+		return time.Unix(whole, int64((sec-float64(whole))*float64(time.Second))).UTC(), nil
+	}
+	i, frac, err := splitEpoch(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	// Each tick of unit is a whole number of nanoseconds which is a power of
+	// ten, so the fraction only has that many significant digits.
+	precision := len(strconv.FormatInt(int64(unit), 10)) - 1
+	if len(frac) > precision {
+		frac = frac[:precision]
+	}
+	var fracNs int64
+	if precision > 0 {
+		fracNs, _ = strconv.ParseInt(frac+strings.Repeat("0", precision-len(frac)), 10, 64)
+	}
+	if strings.HasPrefix(s, "-") {
+		fracNs = -fracNs
+	}
+	per := int64(time.Second / unit)
+	sec, rem := i/per, i%per
+	return time.Unix(sec, rem*int64(unit)+fracNs).UTC(), nil
+}
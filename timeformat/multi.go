@@ -0,0 +1,106 @@
+package timeformat
+
+import (
+	"fmt"
+	"time"
+)
+
+// Layout is a single timestamp format, along with the command-line flag which
+// says what kind of format it is.
+type Layout struct {
+	// FlagName is either "--gotime-fmt" or "--strptime-fmt".
+	FlagName string `json:"flag"`
+	Fmt      string `json:"fmt"`
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("%s '%s'", l.FlagName, l.Fmt)
+}
+
+// LayoutCount is the number of timestamps which were parsed by a Layout.
+type LayoutCount struct {
+	Layout  Layout `json:"layout"`
+	Matched int64  `json:"matched"`
+}
+
+// MultiParser parses timestamps which may be in any one of several layouts,
+// such as logs aggregated from several different producers. Each layout is
+// tried in order, except that the layout which most recently succeeded is
+// tried first, since consecutive lines usually share a layout.
+//
+// A MultiParser keeps count of how many timestamps each layout parsed, so it
+// must not be used from several goroutines at once.
+type MultiParser struct {
+	layouts []Layout
+	parsers []ParseFunc
+	counts  []int64
+	last    int
+}
+
+// NewMultiParser creates a MultiParser which tries every Go time layout in
+// gotimefmts, then every strptime layout in strptimefmts. As with NewFuncs,
+// timestamps without a zone or offset are parsed as being in loc.
+func NewMultiParser(strptimefmts, gotimefmts []string, loc *time.Location) (*MultiParser, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	m := &MultiParser{}
+	for _, f := range gotimefmts {
+		m.layouts = append(m.layouts, Layout{FlagName: "--gotime-fmt", Fmt: f})
+		m.parsers = append(m.parsers, makeParseGotime(f, loc))
+	}
+	for _, f := range strptimefmts {
+		m.layouts = append(m.layouts, Layout{FlagName: "--strptime-fmt", Fmt: f})
+		m.parsers = append(m.parsers, makeParseStrptime(f, loc))
+	}
+	if len(m.layouts) == 0 {
+		return nil, fmt.Errorf("at least one layout must be provided")
+	}
+	m.counts = make([]int64, len(m.layouts))
+	return m, nil
+}
+
+// Parse is a ParseFunc which tries each of the layouts of m.
+func (m *MultiParser) Parse(s string) (time.Time, error) {
+	t, err := m.parsers[m.last](s)
+	if err == nil {
+		m.counts[m.last] += 1
+		return t, nil
+	}
+	for i, parse := range m.parsers {
+		if i == m.last {
+			continue
+		}
+		t, err = parse(s)
+		if err == nil {
+			m.counts[i] += 1
+			m.last = i
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q with any of the %d provided layouts", s, len(m.layouts))
+}
+
+// Fork returns a MultiParser which tries the same layouts as m, but keeps its
+// own counts so that it can be used on another goroutine. Merge adds its
+// counts back into m.
+func (m *MultiParser) Fork() *MultiParser {
+	return &MultiParser{layouts: m.layouts, parsers: m.parsers, counts: make([]int64, len(m.layouts))}
+}
+
+// Merge adds the counts of other, which must be a fork of m, to those of m.
+func (m *MultiParser) Merge(other *MultiParser) {
+	for i, n := range other.counts {
+		m.counts[i] += n
+	}
+}
+
+// Counts reports how many timestamps were parsed by each layout, in the order
+// the layouts are tried.
+func (m *MultiParser) Counts() []LayoutCount {
+	lcs := []LayoutCount{}
+	for i, l := range m.layouts {
+		lcs = append(lcs, LayoutCount{Layout: l, Matched: m.counts[i]})
+	}
+	return lcs
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -20,54 +21,97 @@ type ParseFunc func(string) (time.Time, error)
 type FmtFunc func(time.Time) (string, error)
 
 // NewFuncs tries its best to give you funcs that parse your input and format your output the way
-// you want based on the command-line flag inputs.
-func NewFuncs(strptimefmt, gotimefmt string) (ParseFunc, FmtFunc, error) {
+// you want based on the command-line flag inputs. Timestamps which don't
+// specify their own zone or offset are parsed as being in loc, while those
+// that do keep their offset. A nil loc means UTC.
+func NewFuncs(strptimefmt, gotimefmt string, loc *time.Location) (ParseFunc, FmtFunc, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
 	if strptimefmt == "" && gotimefmt == "" {
 		return parseUnixMillis, fmtUnixMillis, nil
 	}
 
 	if gotimefmt != "" {
-		return makeParseGotime(gotimefmt), makeFmtGotime(gotimefmt), nil
+		return makeParseGotime(gotimefmt, loc), makeFmtGotime(gotimefmt, loc), nil
 	}
 	if strptimefmt != "" {
-		return makeParseStrptime(strptimefmt), makeFmtStrptime(strptimefmt), nil
+		return makeParseStrptime(strptimefmt, loc), makeFmtStrptime(strptimefmt, loc), nil
 	}
 	return nil, nil, fmt.Errorf("logically you shouldn't be able to get this error; congratulations!")
 }
 
 func parseUnixMillis(s string) (time.Time, error) {
-	ts, err := strconv.ParseInt(s, 10, 64)
-	if err != nil {
-		return time.Time{}, err
-	}
-	return time.UnixMilli(ts).UTC(), nil
+	return parseEpoch(s, time.Millisecond)
 }
 func fmtUnixMillis(t time.Time) (string, error) {
 	return fmt.Sprintf("%d", t.UnixMilli()), nil
 }
 
-func makeParseStrptime(sfmt string) ParseFunc {
+func makeParseStrptime(sfmt string, loc *time.Location) ParseFunc {
 	return func(s string) (time.Time, error) {
-		return timefmt.Parse(s, sfmt)
+		return timefmt.ParseInLocation(s, sfmt, loc)
 	}
 }
 
-func makeFmtStrptime(sfmt string) FmtFunc {
+func makeFmtStrptime(sfmt string, loc *time.Location) FmtFunc {
 	return func(t time.Time) (string, error) {
-		return timefmt.Format(t, sfmt), nil
+		return timefmt.Format(t.In(loc), sfmt), nil
 	}
 }
 
-func makeParseGotime(sfmt string) ParseFunc {
+func makeParseGotime(sfmt string, loc *time.Location) ParseFunc {
 	return func(s string) (time.Time, error) {
-		return time.Parse(sfmt, s)
+		return time.ParseInLocation(sfmt, s, loc)
 	}
 }
 
-func makeFmtGotime(sfmt string) FmtFunc {
+func makeFmtGotime(sfmt string, loc *time.Location) FmtFunc {
 	return func(t time.Time) (string, error) {
-		return t.Format(sfmt), nil
+		return t.In(loc).Format(sfmt), nil
+	}
+}
+
+// ParseLocation finds the location named by s, which may be an IANA time
+// zone name such as "America/Los_Angeles", "UTC", "Local", or a fixed offset
+// from UTC such as "+05:30", "-0800", or "+09".
+func ParseLocation(s string) (*time.Location, error) {
+	if s == "" || strings.EqualFold(s, "utc") || s == "Z" {
+		return time.UTC, nil
+	}
+	if s[0] == '+' || s[0] == '-' {
+		return parseFixedOffset(s)
 	}
+	loc, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find time zone %q, expected an IANA name like 'America/Los_Angeles' or an offset like '-08:00': %w", s, err)
+	}
+	return loc, nil
+}
+
+func parseFixedOffset(s string) (*time.Location, error) {
+	sign := 1
+	if s[0] == '-' {
+		sign = -1
+	}
+	digits := strings.Replace(s[1:], ":", "", 1)
+	var hours, minutes int
+	var err error
+	switch len(digits) {
+	case 1, 2:
+		hours, err = strconv.Atoi(digits)
+	case 4:
+		hours, err = strconv.Atoi(digits[:2])
+		if err == nil {
+			minutes, err = strconv.Atoi(digits[2:])
+		}
+	default:
+		err = fmt.Errorf("wrong number of digits")
+	}
+	if err != nil || hours > 14 || minutes > 59 {
+		return nil, fmt.Errorf("cannot parse %q as an offset from UTC like '-08:00'", s)
+	}
+	return time.FixedZone(s, sign*(hours*3600+minutes*60)), nil
 }
 
 // GuessStrptimeFormat checks if your timestamp can be parsed by any commonly
@@ -169,3 +213,85 @@ all the incoming timestamps as format '{{.FormatName}}', provide the following o
 	}
 	return "HINT: Use the '--strptime-format' flag to indicate the format of the incoming timestamps\n\n"
 }
+
+// Detection describes the timestamp format which best fits a sample of
+// timestamps, as found by DetectFormat.
+type Detection struct {
+	// FlagName is the command-line flag which takes Fmt, either
+	// "--gotime-fmt" or "--strptime-fmt". It is empty if the timestamps are
+	// integer milliseconds since epoch, which need no flag.
+	FlagName string
+	Name     string
+	Fmt      string
+	// Matched is the number of sampled timestamps which could be parsed with
+	// this format.
+	Matched int
+}
+
+// DetectFormat picks the format which can parse the most timestamps in
+// samples. The candidates are integer milliseconds since epoch plus every
+// format suggested for any of the samples by GuessGoTimeFormat or
+// GuessStrptimeFormat. When several candidates parse the same number of
+// samples, the one found first wins, with Go time formats preferred over
+// strptime formats just as in GuessTimestampFormat.
+func DetectFormat(samples []string) (Detection, error) {
+	if len(samples) == 0 {
+		return Detection{}, fmt.Errorf("cannot detect the format of timestamps without any samples")
+	}
+	candidates := []Detection{{Name: "epoch milliseconds"}}
+	seen := map[string]bool{}
+	guessers := []struct {
+		FlagName string
+		FmtFunc  func(string) (string, string, error)
+	}{
+		{"--gotime-fmt", GuessGoTimeFormat},
+		{"--strptime-fmt", GuessStrptimeFormat},
+	}
+	for _, s := range samples {
+		for _, g := range guessers {
+			name, format, err := g.FmtFunc(s)
+			if err != nil || seen[g.FlagName+format] {
+				continue
+			}
+			seen[g.FlagName+format] = true
+			candidates = append(candidates, Detection{FlagName: g.FlagName, Name: name, Fmt: format})
+		}
+	}
+
+	best := Detection{}
+	for _, c := range candidates {
+		var parse ParseFunc
+		switch c.FlagName {
+		case "--gotime-fmt":
+			parse = makeParseGotime(c.Fmt, time.UTC)
+		case "--strptime-fmt":
+			parse = makeParseStrptime(c.Fmt, time.UTC)
+		default:
+			parse = parseUnixMillis
+		}
+		for _, s := range samples {
+			if _, err := parse(s); err == nil {
+				c.Matched += 1
+			}
+		}
+		if c.Matched > best.Matched {
+			best = c
+		}
+	}
+	if best.Matched == 0 {
+		return Detection{}, fmt.Errorf("none of the %d sampled timestamps are in a known format, the first being %q", len(samples), samples[0])
+	}
+	return best, nil
+}
+
+// NewDetectedFuncs returns the same funcs as NewFuncs would when given the
+// flag value described by d.
+func NewDetectedFuncs(d Detection, loc *time.Location) (ParseFunc, FmtFunc, error) {
+	switch d.FlagName {
+	case "--gotime-fmt":
+		return NewFuncs("", d.Fmt, loc)
+	case "--strptime-fmt":
+		return NewFuncs(d.Fmt, "", loc)
+	}
+	return NewFuncs("", "", loc)
+}
@@ -3,6 +3,8 @@ package timeformat_test
 import (
 	"fmt"
 	"testing"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/lelandbatey/histogram_timestamps/timeformat"
 
@@ -62,3 +64,218 @@ func TestGuessStrptimeFormat(t *testing.T) {
 		})
 	}
 }
+
+func TestDetectFormat(t *testing.T) {
+	type tcase struct {
+		Samples     []string
+		ExpFlagName string
+		ExpFmt      string
+		ExpMatched  int
+	}
+
+	for idx, tc := range []tcase{
+		{[]string{"1572347470840", "1572347471840"}, "", "", 2},
+		{
+			[]string{"2023-02-27T15:38:17.847773933-08:00", "2023-02-27T15:38:18-08:00", "garbage"},
+			"--gotime-fmt", "2006-01-02T15:04:05.999Z07:00", 2,
+		},
+		{
+			[]string{"2023-02-28 12:24:13 -0800", "2023-02-28 12:24:14 -0800"},
+			"--strptime-fmt", "%Y-%m-%d %H:%M:%S %z", 2,
+		},
+		{
+			// The first line alone looks like a date, but most lines have a
+			// time as well.
+			[]string{"2023-02-28", "2023-02-28 12:16:42.002", "2023-02-28 12:16:43.002"},
+			"--gotime-fmt", "2006-01-02 15:04:05.999", 2,
+		},
+	} {
+		t.Run(fmt.Sprintf("DetectFormat case #%d", idx), func(t *testing.T) {
+			d, err := timeformat.DetectFormat(tc.Samples)
+			require.NoError(t, err)
+			require.Equal(t, tc.ExpFlagName, d.FlagName)
+			require.Equal(t, tc.ExpFmt, d.Fmt)
+			require.Equal(t, tc.ExpMatched, d.Matched)
+
+			parse, _, err := timeformat.NewDetectedFuncs(d, nil)
+			require.NoError(t, err)
+			_, err = parse(tc.Samples[1])
+			require.NoError(t, err)
+		})
+	}
+
+	_, err := timeformat.DetectFormat([]string{"not a timestamp"})
+	require.Error(t, err)
+	_, err = timeformat.DetectFormat(nil)
+	require.Error(t, err)
+}
+
+func TestParseEpoch(t *testing.T) {
+	type tcase struct {
+		TS       string
+		Unit     time.Duration
+		Expected time.Time
+	}
+
+	for idx, tc := range []tcase{
+		{"1699999999", time.Second, time.Unix(1699999999, 0)},
+		{"1699999999.123456", time.Second, time.Unix(1699999999, 123456000)},
+		{"1699999999.1234567891234", time.Second, time.Unix(1699999999, 123456789)},
+		{"1699999999123", time.Millisecond, time.Unix(1699999999, 123000000)},
+		{"1699999999123.5", time.Millisecond, time.Unix(1699999999, 123500000)},
+		{"1699999999123456", time.Microsecond, time.Unix(1699999999, 123456000)},
+		{"1699999999123456789", time.Nanosecond, time.Unix(1699999999, 123456789)},
+		{"-1.5", time.Second, time.Unix(-2, 500000000)},
+		{"-1500", time.Millisecond, time.Unix(-2, 500000000)},
+		{"1.699999999e9", time.Second, time.Unix(1699999999, 0)},
+	} {
+		t.Run(fmt.Sprintf("ParseEpoch case #%d", idx), func(t *testing.T) {
+			got, err := timeformat.MakeParseEpoch(tc.Unit)(tc.TS)
+			require.NoError(t, err)
+			require.True(t, tc.Expected.Equal(got), "expected %v, got %v", tc.Expected, got)
+		})
+	}
+
+	for idx, ts := range []string{"", ".", "12a", "1.2.3", "1.-2"} {
+		_, err := timeformat.MakeParseEpoch(time.Second)(ts)
+		require.Error(t, err, "for bad timestamp #%d %q", idx, ts)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for idx, tc := range []struct {
+		S        string
+		Unit     time.Duration
+		Expected time.Duration
+	}{
+		{"1500", time.Millisecond, 1500 * time.Millisecond},
+		{"1.5", time.Second, 1500 * time.Millisecond},
+		{" 250 ", time.Microsecond, 250 * time.Microsecond},
+		{"0", time.Second, 0},
+		{"1.5s", time.Millisecond, 1500 * time.Millisecond},
+		{"1h2m", time.Nanosecond, time.Hour + 2*time.Minute},
+	} {
+		t.Run(fmt.Sprintf("ParseDuration case #%d", idx), func(t *testing.T) {
+			got, err := timeformat.ParseDuration(tc.S, tc.Unit)
+			require.NoError(t, err)
+			require.Equal(t, tc.Expected, got)
+		})
+	}
+	for _, s := range []string{"", "fast", "1.5x"} {
+		_, err := timeformat.ParseDuration(s, time.Second)
+		require.Error(t, err, s)
+	}
+}
+
+func TestGuessEpochUnit(t *testing.T) {
+	type tcase struct {
+		Samples  []string
+		Expected time.Duration
+	}
+
+	for idx, tc := range []tcase{
+		{[]string{"1699999999", "1700000000"}, time.Second},
+		{[]string{"1699999999.123456"}, time.Second},
+		{[]string{"1699999999123", "1699999999124"}, time.Millisecond},
+		{[]string{"1699999999123456"}, time.Microsecond},
+		{[]string{"1699999999123456789", "garbage", "1699999999123456790"}, time.Nanosecond},
+		// A single outlier doesn't change the unit
+		{[]string{"1699999999", "1699999999", "1699999999123"}, time.Second},
+	} {
+		got, err := timeformat.GuessEpochUnit(tc.Samples)
+		require.NoError(t, err, "for test #%d", idx)
+		require.Equal(t, tc.Expected, got, "for test #%d", idx)
+	}
+	_, err := timeformat.GuessEpochUnit([]string{"2023-02-28"})
+	require.Error(t, err)
+}
+
+func TestMultiParser(t *testing.T) {
+	mp, err := timeformat.NewMultiParser(
+		[]string{"%Y-%m-%d %H:%M:%S"},
+		[]string{"2006-01-02T15:04:05Z07:00", time.RFC1123Z},
+		nil,
+	)
+	require.NoError(t, err)
+
+	for idx, ts := range []string{
+		"2023-02-27T15:38:17-08:00",
+		"2023-02-27 15:38:18",
+		"2023-02-27 15:38:19",
+		"Mon, 27 Feb 2023 15:38:20 -0800",
+		"2023-02-27T15:38:21Z",
+	} {
+		_, err := mp.Parse(ts)
+		require.NoError(t, err, "for timestamp #%d %q", idx, ts)
+	}
+	_, err = mp.Parse("garbage")
+	require.Error(t, err)
+
+	require.Equal(t, []timeformat.LayoutCount{
+		{Layout: timeformat.Layout{FlagName: "--gotime-fmt", Fmt: "2006-01-02T15:04:05Z07:00"}, Matched: 2},
+		{Layout: timeformat.Layout{FlagName: "--gotime-fmt", Fmt: time.RFC1123Z}, Matched: 1},
+		{Layout: timeformat.Layout{FlagName: "--strptime-fmt", Fmt: "%Y-%m-%d %H:%M:%S"}, Matched: 2},
+	}, mp.Counts())
+
+	_, err = timeformat.NewMultiParser(nil, nil, nil)
+	require.Error(t, err)
+}
+
+func TestNewFuncsInLocation(t *testing.T) {
+	la, err := timeformat.ParseLocation("America/Los_Angeles")
+	require.NoError(t, err)
+
+	type tcase struct {
+		Strptime string
+		Gotime   string
+		TS       string
+		Expected time.Time
+	}
+	for idx, tc := range []tcase{
+		// Standard time is 8 hours behind UTC, daylight time is 7 behind.
+		{"%Y-%m-%d %H:%M:%S", "", "2023-01-15 12:00:00", time.Date(2023, 1, 15, 20, 0, 0, 0, time.UTC)},
+		{"%Y-%m-%d %H:%M:%S", "", "2023-07-15 12:00:00", time.Date(2023, 7, 15, 19, 0, 0, 0, time.UTC)},
+		{"", "2006-01-02 15:04:05", "2023-01-15 12:00:00", time.Date(2023, 1, 15, 20, 0, 0, 0, time.UTC)},
+		{"", "2006-01-02 15:04:05", "2023-07-15 12:00:00", time.Date(2023, 7, 15, 19, 0, 0, 0, time.UTC)},
+		// Either side of the spring-forward transition on 2023-03-12
+		{"", "2006-01-02 15:04:05", "2023-03-12 01:59:59", time.Date(2023, 3, 12, 9, 59, 59, 0, time.UTC)},
+		{"", "2006-01-02 15:04:05", "2023-03-12 03:00:00", time.Date(2023, 3, 12, 10, 0, 0, 0, time.UTC)},
+		// Timestamps with their own offset keep it
+		{"%Y-%m-%d %H:%M:%S %z", "", "2023-07-15 12:00:00 -0500", time.Date(2023, 7, 15, 17, 0, 0, 0, time.UTC)},
+		{"", time.RFC3339, "2023-07-15T12:00:00Z", time.Date(2023, 7, 15, 12, 0, 0, 0, time.UTC)},
+		// Epoch timestamps are unaffected
+		{"", "", "1689447600000", time.Date(2023, 7, 15, 19, 0, 0, 0, time.UTC)},
+	} {
+		parse, _, err := timeformat.NewFuncs(tc.Strptime, tc.Gotime, la)
+		require.NoError(t, err, "for test #%d", idx)
+		got, err := parse(tc.TS)
+		require.NoError(t, err, "for test #%d", idx)
+		require.True(t, tc.Expected.Equal(got), "for test #%d: expected %v, got %v", idx, tc.Expected, got.UTC())
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	type tcase struct {
+		Name      string
+		ExpOffset int
+	}
+	ref := time.Date(2023, 1, 15, 12, 0, 0, 0, time.UTC)
+	for idx, tc := range []tcase{
+		{"UTC", 0},
+		{"", 0},
+		{"America/Los_Angeles", -8 * 3600},
+		{"Asia/Kolkata", 5*3600 + 30*60},
+		{"+05:30", 5*3600 + 30*60},
+		{"-0800", -8 * 3600},
+		{"+09", 9 * 3600},
+	} {
+		loc, err := timeformat.ParseLocation(tc.Name)
+		require.NoError(t, err, "for test #%d", idx)
+		_, offset := ref.In(loc).Zone()
+		require.Equal(t, tc.ExpOffset, offset, "for test #%d", idx)
+	}
+	for idx, name := range []string{"Not/A_Zone", "+5:3", "+25:00", "-08:75"} {
+		_, err := timeformat.ParseLocation(name)
+		require.Error(t, err, "for bad location #%d %q", idx, name)
+	}
+}